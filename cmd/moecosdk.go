@@ -1,13 +1,57 @@
 package main
 
 import (
+	"alert"
+	"clients/prot"
+	"crypto/tls"
+	"db"
+	"flag"
+	"fmt"
+	"os"
 	"sdk"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/sirupsen/logrus"
 )
 
+const dbPath = "./moeco.db"
+
 func main() {
+	discover := flag.Bool("discover", false, "collect nearby devices which aren't registered")
+	discoverUpload := flag.Bool("discover-upload", false, "upload the collected devices to the masternode, implies -discover")
+	listDiscovered := flag.Bool("list-discovered", false, "print the collected devices and exit")
+	alerts := flag.Bool("alerts", true, "log devices going offline and back online")
+	alertWebhook := flag.String("alert-webhook", "", "post offline/online events as JSON to this URL")
+	alertExec := flag.String("alert-exec", "", "run this command for every offline/online event")
+	masternodeAlerts := flag.Bool("masternode-alerts", false, "send offline/online events to the masternode")
+	endpoints := flag.String("endpoints", "", "comma separated masternodes to fail over to, in order of preference")
+	roundRobin := flag.Bool("round-robin", false, "spread requests over the healthy masternodes")
+	failback := flag.Duration("failback", 5*time.Minute, "how long a preferred masternode must be healthy to go back to it")
+	tlsCA := flag.String("tls-ca", "", "PEM bundle of the CAs trusted instead of the system ones")
+	tlsPins := flag.String("tls-pins", "", "comma separated base64 SHA-256 pins of the masternode public keys")
+	tlsCert := flag.String("tls-cert", "", "PEM client certificate for mutual TLS")
+	tlsKey := flag.String("tls-key", "", "PEM key of the client certificate")
+	tlsP12 := flag.String("tls-p12", "", "PKCS#12 bundle of the client certificate and key, instead of -tls-cert and -tls-key")
+	tlsP12Password := flag.String("tls-p12-password", os.Getenv("MOECO_TLS_P12_PASSWORD"), "password of the PKCS#12 bundle")
+	tlsMinVersion := flag.String("tls-min-version", "1.2", "minimum TLS version, 1.2 or 1.3")
+	transport := flag.String("transport", prot.TransportDirect, "connection to the masternodes: direct, http_proxy, socks5 or unix")
+	transportAddress := flag.String("transport-address", "", "host:port of the proxy, or path of the Unix socket")
+	transportUser := flag.String("transport-user", "", "username of the proxy")
+	transportPassword := flag.String("transport-password", os.Getenv("MOECO_TRANSPORT_PASSWORD"), "password of the proxy")
+	flag.Parse()
+
+	if *listDiscovered {
+		err := printDiscovered()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	logger := logrus.New()
 	/*
 	 * All logs redirected to stdout
@@ -16,11 +60,58 @@ func main() {
 	logger.SetLevel(logrus.InfoLevel)
 	logger.SetFormatter(&logrus.JSONFormatter{})
 
+	var opts []sdk.Option
+	if *discover || *discoverUpload {
+		opts = append(opts, sdk.WithDiscovery(*discoverUpload))
+	}
+	if *alerts {
+		opts = append(opts, sdk.WithAlertSinks(alert.NewLogSink(logger)))
+	}
+	if *alertWebhook != "" {
+		opts = append(opts, sdk.WithAlertSinks(alert.NewWebhookSink(*alertWebhook)))
+	}
+	if *alertExec != "" {
+		opts = append(opts, sdk.WithAlertSinks(alert.NewExecSink(*alertExec)))
+	}
+	if *masternodeAlerts {
+		opts = append(opts, sdk.WithMasternodeAlerts())
+	}
+	if *endpoints != "" {
+		opts = append(opts, sdk.WithEndpoints(splitList(*endpoints)...))
+	}
+	if *roundRobin {
+		opts = append(opts, sdk.WithRoundRobin())
+	}
+	opts = append(opts, sdk.WithFailback(*failback))
+	minVersion, ok := tlsVersions[*tlsMinVersion]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "invalid TLS version %s\n", *tlsMinVersion)
+		os.Exit(2)
+	}
+	opts = append(opts, sdk.WithTLS(prot.TLSConfig{
+		CAFile:         *tlsCA,
+		Pins:           splitList(*tlsPins),
+		CertFile:       *tlsCert,
+		KeyFile:        *tlsKey,
+		PKCS12File:     *tlsP12,
+		PKCS12Password: *tlsP12Password,
+		MinVersion:     minVersion,
+	}))
+	if *transport != prot.TransportDirect {
+		opts = append(opts, sdk.WithTransport(prot.TransportConfig{
+			Kind:     *transport,
+			Address:  *transportAddress,
+			Username: *transportUser,
+			Password: *transportPassword,
+		}))
+	}
+
 	MoecoSdk := sdk.NewMoecoSDK(
 		"https://prod114.moeco.io:443",
 		"API_KEY",
 		"NODE_UUID",
-		"./moeco.db",
+		dbPath,
+		opts...,
 	)
 
 	err, errChan := MoecoSdk.Start(logger)
@@ -34,3 +125,41 @@ func main() {
 		logger.Errorf("%+v", err)
 	}
 }
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// splitList splits a comma separated flag, dropping empty items.
+func splitList(s string) []string {
+	var res []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+func printDiscovered() error {
+	database, err := db.NewDBAdapter(dbPath)
+	if err != nil {
+		return err
+	}
+	discovered, err := database.GetDiscovered()
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ADDRESS\tNAME\tRSSI\tCOMPANY\tSERVICES\tADVS\tLAST SEEN")
+	for _, d := range discovered {
+		company := "-"
+		if d.CompanyID >= 0 {
+			company = fmt.Sprintf("0x%04x", d.CompanyID)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%d\t%s\n", d.Address, d.Name, d.RSSI, company, d.Services,
+			d.AdvCount, time.Unix(int64(d.LastSeen), 0).Format(time.RFC3339))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,154 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"db"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	EventOffline = "offline"
+	EventOnline  = "online"
+)
+
+// Event reports a whitelisted device passing its staleness threshold.
+type Event struct {
+	Type          string    `json:"type"`
+	DeviceHash    string    `json:"device_hash"`
+	DeviceGroupID string    `json:"device_group_id"`
+	LastSeen      time.Time `json:"last_seen"`
+	Threshold     int       `json:"threshold"`
+	Timestamp     time.Time `json:"timestamp"`
+}
+
+// Sink delivers events somewhere.
+type Sink interface {
+	Send(e Event) error
+}
+
+// LogSink writes events to the log.
+type LogSink struct {
+	log *logrus.Logger
+}
+
+func NewLogSink(log *logrus.Logger) *LogSink {
+	return &LogSink{log: log}
+}
+
+func (s *LogSink) Send(e Event) error {
+	entry := s.log.WithFields(logrus.Fields{
+		"event":           e.Type,
+		"device_hash":     e.DeviceHash,
+		"device_group_id": e.DeviceGroupID,
+		"last_seen":       e.LastSeen,
+		"threshold":       e.Threshold,
+	})
+	if e.Type == EventOffline {
+		entry.Warn("Device is offline")
+	} else {
+		entry.Info("Device is online")
+	}
+	return nil
+}
+
+// WebhookSink posts events as JSON to an URL.
+type WebhookSink struct {
+	url    string
+	client http.Client
+}
+
+func NewWebhookSink(url string) *WebhookSink {
+	return &WebhookSink{
+		url:    url,
+		client: http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *WebhookSink) Send(e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s responded with %s", s.url, resp.Status)
+	}
+	return nil
+}
+
+// ExecSink runs a command for every event. The event is passed as JSON on
+// stdin and its main fields in MOECO_* environment variables. The command
+// is killed if it runs for longer than the timeout.
+type ExecSink struct {
+	path    string
+	args    []string
+	timeout time.Duration
+}
+
+func NewExecSink(path string, args ...string) *ExecSink {
+	return &ExecSink{path: path, args: args, timeout: 10 * time.Second}
+}
+
+func (s *ExecSink) Send(e Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.path, s.args...)
+	// don't wait for children keeping the output open
+	cmd.WaitDelay = time.Second
+	cmd.Stdin = bytes.NewBuffer(body)
+	cmd.Env = append(os.Environ(),
+		"MOECO_EVENT="+e.Type,
+		"MOECO_DEVICE_HASH="+e.DeviceHash,
+		"MOECO_DEVICE_GROUP_ID="+e.DeviceGroupID,
+		"MOECO_LAST_SEEN="+e.LastSeen.Format(time.RFC3339),
+	)
+	out, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("alert hook %s timed out after %s, output: %s", s.path, s.timeout, out)
+	}
+	if err != nil {
+		return fmt.Errorf("alert hook %s failed: %s, output: %s", s.path, err, out)
+	}
+	return nil
+}
+
+// TransactionSink stores events as transactions of the device, so they reach
+// the masternode with the next sync.
+type TransactionSink struct {
+	db *db.DBAdapter
+}
+
+func NewTransactionSink(database *db.DBAdapter) *TransactionSink {
+	return &TransactionSink{db: database}
+}
+
+func (s *TransactionSink) Send(e Event) error {
+	payload, err := json.Marshal(map[string]Event{"_alert": e})
+	if err != nil {
+		return err
+	}
+	return s.db.InsertTransaction(db.Transaction{
+		Hash:       "",
+		DeviceHash: e.DeviceHash,
+		Timestamp:  db.Timestamp(e.Timestamp),
+		Uplink:     0,
+		Sended:     0,
+		Payload:    string(payload),
+	})
+}
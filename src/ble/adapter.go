@@ -0,0 +1,114 @@
+package ble
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mihalicyn/gatt"
+)
+
+// sightingWindow is how long an advertisement is taken into account when
+// choosing the adapter for a new session.
+const sightingWindow = 5 * time.Second
+
+// collectWindow gives the other adapters a chance to hear a device before a
+// session is assigned. It is not applied when only one adapter is managed.
+const collectWindow = 1 * time.Second
+
+// adapter is a single HCI controller managed by MoecoBLE.
+type adapter struct {
+	id       int
+	device   gatt.Device
+	maxConns int
+	sessions int
+	scanning bool
+}
+
+// sighting is the last advertisement of a device heard by an adapter.
+type sighting struct {
+	peripheral gatt.Peripheral
+	rssi       int
+	firstSeen  time.Time
+	lastSeen   time.Time
+}
+
+func (a *adapter) String() string {
+	if a.id < 0 {
+		return "hci(auto)"
+	}
+	return fmt.Sprintf("hci%d", a.id)
+}
+
+func (a *adapter) full() bool {
+	return a.sessions >= a.maxConns
+}
+
+func (a *adapter) startScan() {
+	if a.scanning || a.full() {
+		return
+	}
+	a.scanning = true
+	a.device.Scan([]gatt.UUID{}, true)
+}
+
+func (a *adapter) stopScan() {
+	if !a.scanning {
+		return
+	}
+	a.scanning = false
+	a.device.StopScanning()
+}
+
+// recordSighting stores the advertisement heard by the adapter. Must be
+// called with ble.mu held.
+func (ble *MoecoBLE) recordSighting(a *adapter, hash string, p gatt.Peripheral, rssi int) {
+	now := time.Now()
+	devSightings, ok := ble.sightings[hash]
+	if !ok {
+		devSightings = make(map[*adapter]*sighting)
+		ble.sightings[hash] = devSightings
+	}
+	s, ok := devSightings[a]
+	if !ok || now.Sub(s.lastSeen) > sightingWindow {
+		s = &sighting{firstSeen: now}
+		devSightings[a] = s
+	}
+	s.peripheral = p
+	s.rssi = rssi
+	s.lastSeen = now
+}
+
+// pickAdapter chooses the least loaded adapter that recently heard the
+// device, preferring the best RSSI between equally loaded ones. Must be
+// called with ble.mu held.
+func (ble *MoecoBLE) pickAdapter(hash string) (*adapter, *sighting) {
+	now := time.Now()
+	var (
+		best      *adapter
+		bestSight *sighting
+		earliest  time.Time
+	)
+	for a, s := range ble.sightings[hash] {
+		if now.Sub(s.lastSeen) > sightingWindow {
+			continue
+		}
+		if earliest.IsZero() || s.firstSeen.Before(earliest) {
+			earliest = s.firstSeen
+		}
+		if a.full() {
+			continue
+		}
+		if best == nil ||
+			a.sessions < best.sessions ||
+			(a.sessions == best.sessions && s.rssi > bestSight.rssi) {
+			best, bestSight = a, s
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+	if len(ble.adapters) > 1 && now.Sub(earliest) < collectWindow {
+		return nil, nil
+	}
+	return best, bestSight
+}
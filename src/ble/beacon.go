@@ -0,0 +1,292 @@
+package ble
+
+import (
+	"clients/prot"
+	"db"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mihalicyn/gatt"
+)
+
+const (
+	appleCompanyID = 0x004C
+	// defaultBeaconInterval limits the transactions of a beacon frame type.
+	defaultBeaconInterval = time.Minute
+)
+
+var eddystoneUUID = gatt.UUID16(0xFEAA)
+
+// beacon is a parsed beacon frame. Frames like Eddystone TLM carry no
+// identity and are attributed by the address they come from.
+type beacon struct {
+	kind     string
+	identity string
+	fields   map[string]string
+}
+
+// parseBeacons returns the beacon frames found in the advertisement.
+func parseBeacons(adv *gatt.Advertisement) []beacon {
+	var beacons []beacon
+	if b, ok := parseManufacturerBeacon(adv.ManufacturerData); ok {
+		beacons = append(beacons, b)
+	}
+	for _, sd := range adv.ServiceData {
+		if !sd.UUID.Equal(eddystoneUUID) {
+			continue
+		}
+		if b, ok := parseEddystone(sd.Data); ok {
+			beacons = append(beacons, b)
+		}
+	}
+	return beacons
+}
+
+func formatUUID(b []byte) string {
+	s := hex.EncodeToString(b)
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:32]
+}
+
+func parseManufacturerBeacon(d []byte) (beacon, bool) {
+	if len(d) < 4 {
+		return beacon{}, false
+	}
+	company := binary.LittleEndian.Uint16(d[0:2])
+	switch {
+	case company == appleCompanyID && d[2] == 0x02 && d[3] == 0x15 && len(d) >= 25:
+		// iBeacon: uuid, major, minor, measured power
+		uuid := formatUUID(d[4:20])
+		major := strconv.Itoa(int(binary.BigEndian.Uint16(d[20:22])))
+		minor := strconv.Itoa(int(binary.BigEndian.Uint16(d[22:24])))
+		return beacon{
+			kind:     prot.BeaconIBeacon,
+			identity: "ibeacon:" + uuid + ":" + major + ":" + minor,
+			fields: map[string]string{
+				"uuid":     uuid,
+				"major":    major,
+				"minor":    minor,
+				"tx_power": strconv.Itoa(int(int8(d[24]))),
+			},
+		}, true
+	case d[2] == 0xBE && d[3] == 0xAC && len(d) >= 26:
+		// AltBeacon: 20 byte beacon id, reference RSSI, manufacturer reserved
+		id1 := formatUUID(d[4:20])
+		id2 := strconv.Itoa(int(binary.BigEndian.Uint16(d[20:22])))
+		id3 := strconv.Itoa(int(binary.BigEndian.Uint16(d[22:24])))
+		return beacon{
+			kind:     prot.BeaconAltBeacon,
+			identity: "altbeacon:" + id1 + ":" + id2 + ":" + id3,
+			fields: map[string]string{
+				"manufacturer":   fmt.Sprintf("0x%04x", company),
+				"id1":            id1,
+				"id2":            id2,
+				"id3":            id3,
+				"reference_rssi": strconv.Itoa(int(int8(d[24]))),
+				"reserved":       fmt.Sprintf("0x%02x", d[25]),
+			},
+		}, true
+	}
+	return beacon{}, false
+}
+
+var eddystoneURLSchemes = []string{"http://www.", "https://www.", "http://", "https://"}
+
+var eddystoneURLExpansions = []string{".com/", ".org/", ".edu/", ".net/", ".info/", ".biz/", ".gov/",
+	".com", ".org", ".edu", ".net", ".info", ".biz", ".gov"}
+
+func parseEddystone(d []byte) (beacon, bool) {
+	if len(d) < 2 {
+		return beacon{}, false
+	}
+	switch d[0] {
+	case 0x00:
+		if len(d) < 18 {
+			return beacon{}, false
+		}
+		namespace := hex.EncodeToString(d[2:12])
+		instance := hex.EncodeToString(d[12:18])
+		return beacon{
+			kind:     prot.BeaconEddystoneUID,
+			identity: "eddystone:" + namespace + ":" + instance,
+			fields: map[string]string{
+				"namespace": namespace,
+				"instance":  instance,
+				"tx_power":  strconv.Itoa(int(int8(d[1]))),
+			},
+		}, true
+	case 0x10:
+		if len(d) < 3 || int(d[2]) >= len(eddystoneURLSchemes) {
+			return beacon{}, false
+		}
+		url := eddystoneURLSchemes[d[2]]
+		for _, c := range d[3:] {
+			if int(c) < len(eddystoneURLExpansions) {
+				url += eddystoneURLExpansions[c]
+			} else {
+				url += string(rune(c))
+			}
+		}
+		return beacon{
+			kind: prot.BeaconEddystoneURL,
+			fields: map[string]string{
+				"url":      url,
+				"tx_power": strconv.Itoa(int(int8(d[1]))),
+			},
+		}, true
+	case 0x20:
+		if d[1] != 0x00 {
+			// encrypted TLM can't be read without the key
+			return beacon{
+				kind:   prot.BeaconEddystoneTLM,
+				fields: map[string]string{"etlm": hex.EncodeToString(d[2:])},
+			}, true
+		}
+		if len(d) < 14 {
+			return beacon{}, false
+		}
+		fields := map[string]string{
+			// 0.1 second resolution
+			"uptime":    formatFloat(float64(binary.BigEndian.Uint32(d[10:14])) / 10),
+			"adv_count": strconv.FormatUint(uint64(binary.BigEndian.Uint32(d[6:10])), 10),
+		}
+		if mv := binary.BigEndian.Uint16(d[2:4]); mv != 0 {
+			fields["battery_mv"] = strconv.Itoa(int(mv))
+		}
+		if temp := binary.BigEndian.Uint16(d[4:6]); temp != 0x8000 {
+			// signed 8.8 fixed point
+			fields["temperature"] = formatFloat(float64(int16(temp)) / 256)
+		}
+		return beacon{kind: prot.BeaconEddystoneTLM, fields: fields}, true
+	case 0x30:
+		if len(d) < 10 {
+			return beacon{}, false
+		}
+		eid := hex.EncodeToString(d[2:10])
+		return beacon{
+			kind:     prot.BeaconEddystoneEID,
+			identity: "eddystone-eid:" + eid,
+			fields: map[string]string{
+				"eid":      eid,
+				"tx_power": strconv.Itoa(int(int8(d[1]))),
+			},
+		}, true
+	}
+	return beacon{}, false
+}
+
+// matchesIdentity tells whether the beacon identity is whitelisted by the
+// device hash, which may leave out trailing parts of the identity.
+func matchesIdentity(identity, hash string) bool {
+	if identity == "" {
+		return false
+	}
+	identity, hash = strings.ToLower(identity), strings.ToLower(hash)
+	return identity == hash || strings.HasPrefix(identity, hash+":")
+}
+
+// beaconTracker attributes beacon frames to devices and limits the rate
+// they are sent at.
+type beaconTracker struct {
+	mu       sync.Mutex
+	owners   map[string]string
+	lastSent map[string]time.Time
+}
+
+func newBeaconTracker() *beaconTracker {
+	return &beaconTracker{
+		owners:   make(map[string]string),
+		lastSent: make(map[string]time.Time),
+	}
+}
+
+// match returns the frames of the advertisement that belong to the device.
+// A device owning the advertisement, matched by its group strategy, owns
+// every frame of it. Otherwise frames without identity belong to the device
+// whose identity was last seen from the same address.
+func (t *beaconTracker) match(hash, address string, owned bool, beacons []beacon) ([]beacon, bool) {
+	if owned {
+		return beacons, true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var matched []beacon
+	for _, b := range beacons {
+		if matchesIdentity(b.identity, hash) {
+			t.owners[strings.ToLower(address)] = hash
+			matched = append(matched, b)
+		}
+	}
+	for _, b := range beacons {
+		if b.identity == "" && t.owners[strings.ToLower(address)] == hash {
+			matched = append(matched, b)
+		}
+	}
+	return matched, len(matched) > 0
+}
+
+// due tells whether a frame of the kind may be sent for the device now.
+func (t *beaconTracker) due(hash, kind string, interval time.Duration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := hash + "/" + kind
+	if last, ok := t.lastSent[key]; ok && time.Since(last) < interval {
+		return false
+	}
+	t.lastSent[key] = time.Now()
+	return true
+}
+
+// sendBeacons puts a transaction with the beacon frames of the device on
+// the channel, each frame type keyed by its own section.
+func (ble *MoecoBLE) sendBeacons(device db.Device, address string, beacons []beacon, rssi int,
+	settings prot.BeaconSettings) {
+	interval := defaultBeaconInterval
+	if settings.Interval > 0 {
+		interval = time.Duration(settings.Interval) * time.Second
+	}
+	values := make(map[string]map[string]string)
+	for _, b := range beacons {
+		if len(settings.Types) > 0 && !containsString(settings.Types, b.kind) {
+			continue
+		}
+		if !ble.beacons.due(device.Hash, b.kind, interval) {
+			continue
+		}
+		fields := map[string]string{
+			"rssi":    strconv.Itoa(rssi),
+			"address": address,
+		}
+		for k, v := range b.fields {
+			fields[k] = v
+		}
+		values[b.kind] = fields
+	}
+	if len(values) == 0 {
+		return
+	}
+	payload, err := json.Marshal(values)
+	if err != nil {
+		*ble.errors <- err
+		return
+	}
+	*ble.transactions <- db.Transaction{
+		DeviceHash: device.Hash,
+		Timestamp:  db.Timestamp(time.Now()),
+		Payload:    string(payload),
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
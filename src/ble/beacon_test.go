@@ -0,0 +1,183 @@
+package ble
+
+import (
+	"clients/prot"
+	"reflect"
+	"testing"
+)
+
+func TestParseManufacturerBeacon(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		// zero when the data isn't a beacon
+		want beacon
+	}{
+		{
+			// the UUID of Apple's AirLocate sample
+			name: "ibeacon",
+			data: "4c 00 02 15 e2 c5 6d b5 df fb 48 d2 b0 60 d0 f5 a7 10 96 e0 00 01 00 02 c5",
+			want: beacon{
+				kind:     prot.BeaconIBeacon,
+				identity: "ibeacon:e2c56db5-dffb-48d2-b060-d0f5a71096e0:1:2",
+				fields: map[string]string{
+					"uuid":     "e2c56db5-dffb-48d2-b060-d0f5a71096e0",
+					"major":    "1",
+					"minor":    "2",
+					"tx_power": "-59",
+				},
+			},
+		},
+		{
+			name: "altbeacon",
+			data: "18 01 be ac 2f 23 44 54 cf 6d 4a 0f ad f2 f4 91 1b a9 ff a6 00 01 00 02 c5 00",
+			want: beacon{
+				kind:     prot.BeaconAltBeacon,
+				identity: "altbeacon:2f234454-cf6d-4a0f-adf2-f4911ba9ffa6:1:2",
+				fields: map[string]string{
+					"manufacturer":   "0x0118",
+					"id1":            "2f234454-cf6d-4a0f-adf2-f4911ba9ffa6",
+					"id2":            "1",
+					"id3":            "2",
+					"reference_rssi": "-59",
+					"reserved":       "0x00",
+				},
+			},
+		},
+		{name: "short ibeacon", data: "4c 00 02 15 e2 c5 6d b5 df fb 48 d2 b0 60 d0 f5 a7 10 96 e0 00 01 00 02"},
+		{name: "short altbeacon", data: "18 01 be ac 2f 23 44 54 cf 6d 4a 0f ad f2 f4 91 1b a9 ff a6 00 01 00 02 c5"},
+		{name: "other apple data", data: "4c 00 10 05 01 18 2c 6a 8e"},
+		{name: "too short", data: "4c 00 02"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, ok := parseManufacturerBeacon(unhex(t, tt.data))
+			if ok != (tt.want.kind != "") {
+				t.Fatalf("parsed %t, want %t", ok, !ok)
+			}
+			if ok && !reflect.DeepEqual(b, tt.want) {
+				t.Errorf("beacon %+v, want %+v", b, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseEddystone(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want beacon
+	}{
+		{
+			name: "uid",
+			data: "00 e7 ed d1 eb ea c0 4e 5d ef a0 17 01 23 45 67 89 ab 00 00",
+			want: beacon{
+				kind:     prot.BeaconEddystoneUID,
+				identity: "eddystone:edd1ebeac04e5defa017:0123456789ab",
+				fields: map[string]string{
+					"namespace": "edd1ebeac04e5defa017",
+					"instance":  "0123456789ab",
+					"tx_power":  "-25",
+				},
+			},
+		},
+		{
+			// the example of the Eddystone-URL specification
+			name: "url",
+			data: "10 eb 00 67 6f 6f 67 6c 65 07",
+			want: beacon{
+				kind: prot.BeaconEddystoneURL,
+				fields: map[string]string{
+					"url":      "http://www.google.com",
+					"tx_power": "-21",
+				},
+			},
+		},
+		{
+			name: "url with path",
+			data: "10 00 03 65 78 61 6d 70 6c 65 00 61 62 63",
+			want: beacon{
+				kind: prot.BeaconEddystoneURL,
+				fields: map[string]string{
+					"url":      "https://example.com/abc",
+					"tx_power": "0",
+				},
+			},
+		},
+		{
+			name: "tlm",
+			data: "20 00 0b b8 18 80 00 00 01 00 00 00 0a 05",
+			want: beacon{
+				kind: prot.BeaconEddystoneTLM,
+				fields: map[string]string{
+					"battery_mv":  "3000",
+					"temperature": "24.5",
+					"adv_count":   "256",
+					"uptime":      "256.5",
+				},
+			},
+		},
+		{
+			// no battery voltage and temperature
+			name: "tlm unsupported",
+			data: "20 00 00 00 80 00 00 00 00 01 00 00 00 00",
+			want: beacon{
+				kind: prot.BeaconEddystoneTLM,
+				fields: map[string]string{
+					"adv_count": "1",
+					"uptime":    "0",
+				},
+			},
+		},
+		{
+			name: "tlm below zero",
+			data: "20 00 0c e4 ff 80 00 00 00 0a 00 00 00 64",
+			want: beacon{
+				kind: prot.BeaconEddystoneTLM,
+				fields: map[string]string{
+					"battery_mv":  "3300",
+					"temperature": "-0.5",
+					"adv_count":   "10",
+					"uptime":      "10",
+				},
+			},
+		},
+		{
+			name: "encrypted tlm",
+			data: "20 01 01 02 03 04 05 06 07 08 09 0a 0b 0c 12 34 56 78",
+			want: beacon{
+				kind:   prot.BeaconEddystoneTLM,
+				fields: map[string]string{"etlm": "0102030405060708090a0b0c12345678"},
+			},
+		},
+		{
+			name: "eid",
+			data: "30 e7 01 02 03 04 05 06 07 08",
+			want: beacon{
+				kind:     prot.BeaconEddystoneEID,
+				identity: "eddystone-eid:0102030405060708",
+				fields: map[string]string{
+					"eid":      "0102030405060708",
+					"tx_power": "-25",
+				},
+			},
+		},
+		{name: "short uid", data: "00 e7 ed d1 eb ea c0 4e 5d ef a0 17 01 23 45 67 89"},
+		{name: "unknown url scheme", data: "10 eb 04 67 6f 6f 67 6c 65 07"},
+		{name: "short tlm", data: "20 00 0b b8 18 80 00 00 01 00 00 00 0a"},
+		{name: "short eid", data: "30 e7 01 02 03 04 05 06 07"},
+		{name: "unknown frame", data: "40 00 01 02"},
+		{name: "too short", data: "00"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b, ok := parseEddystone(unhex(t, tt.data))
+			if ok != (tt.want.kind != "") {
+				t.Fatalf("parsed %t, want %t", ok, !ok)
+			}
+			if ok && !reflect.DeepEqual(b, tt.want) {
+				t.Errorf("beacon %+v, want %+v", b, tt.want)
+			}
+		})
+	}
+}
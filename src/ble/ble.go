@@ -6,13 +6,14 @@ import (
 	"db"
 	"log"
 	"fmt"
+	"strconv"
 	"strings"
-	"encoding/json"
 	"encoding/hex"
+	"sync"
 	"time"
 
 	"github.com/mihalicyn/gatt"
-	"github.com/mihalicyn/gatt/examples/option"
+	"github.com/mihalicyn/gatt/linux/cmd"
 	"github.com/sirupsen/logrus"
 )
 
@@ -24,24 +25,94 @@ type MoecoBLE struct {
 	transactionsBufSize     int
 	errors                  *chan error
 	transactions            *chan db.Transaction
-	deviceTimeouts          map[string]time.Time
+	failureInterval         time.Duration
+	maxBackoff              time.Duration
+	scheduler               *scheduler
+	presenceWindow          time.Duration
+	presence                *presence
+	adapterIDs              []int
+	maxConnections          int
+	adapters                []*adapter
+	sightings               map[string]map[*adapter]*sighting
+	sessions                map[string]*session
+	beacons                 *beaconTracker
+	discoveryEnabled        bool
+	discovery               *discovery
+	mu                      sync.Mutex
+	// cache of the whitelist and the settings of the device groups by
+	// lowercased ID, see RefreshWhitelist
+	whitelistMu sync.RWMutex
+	whitelist   []db.Device
+	groups      map[string]prot.DeviceGroupSettings
+}
+
+// session is a connection to a whitelisted device held by one of the adapters.
+type session struct {
+	adapter      *adapter
+	device       db.Device
+	peripheral   gatt.Peripheral
+	peripheralID string
+	connected    bool
+	// ends the session unless it is connected within connectTimeout
+	timer *time.Timer
+}
+
+// connectTimeout bounds the time a session may wait for the connection to
+// be established before it is counted as failed.
+const connectTimeout = 30 * time.Second
+
+// Option configures MoecoBLE, see NewMoecoBLE.
+type Option func(*MoecoBLE)
+
+// WithAdapters sets the HCI device indexes to be managed.
+// Index -1 selects the first available device.
+func WithAdapters(ids ...int) Option {
+	return func(ble *MoecoBLE) {
+		ble.adapterIDs = ids
+	}
+}
+
+// WithBackoff sets the cooldown after a failed session and the limit it may
+// grow to while sessions keep failing.
+func WithBackoff(failureInterval, maxBackoff time.Duration) Option {
+	return func(ble *MoecoBLE) {
+		ble.failureInterval = failureInterval
+		ble.maxBackoff = maxBackoff
+	}
+}
+
+// WithPresenceWindow sets the window advertisements are counted in.
+func WithPresenceWindow(window time.Duration) Option {
+	return func(ble *MoecoBLE) {
+		if window >= time.Second {
+			ble.presenceWindow = window
+		}
+	}
+}
+
+// WithMaxConnections sets the number of simultaneous sessions per adapter.
+func WithMaxConnections(n int) Option {
+	return func(ble *MoecoBLE) {
+		ble.maxConnections = n
+	}
+}
+
+// WithDiscovery collects the peripherals heard which aren't whitelisted,
+// see Discovered.
+func WithDiscovery() Option {
+	return func(ble *MoecoBLE) {
+		ble.discoveryEnabled = true
+	}
 }
 
 func NewMoecoBLE(
 	logger *logrus.Logger, database *db.DBAdapter,errors *chan error,
 	transactions *chan db.Transaction, transactionsBufSize int,
-	charNotifyInterval int, deviceConnInterval int) (*MoecoBLE, error) {
+	charNotifyInterval int, deviceConnInterval int, opts ...Option) (*MoecoBLE, error) {
 	// catch logs from gatt
 	log.SetOutput(logger.Writer())
 
-	d, err := gatt.NewDevice(option.DefaultClientOptions...)
-	if err != nil {
-		logger.Fatalf("Failed to open device, err: %s\n", err)
-		return nil, err
-	}
-
 	//m.transactions = make(chan db.Transaction, m.transactionsBufSize)
-	deviceTimeouts := make(map[string]time.Time)
 
 	ble := &MoecoBLE{
 		log:                 logger,
@@ -51,59 +122,305 @@ func NewMoecoBLE(
 		transactionsBufSize: transactionsBufSize,
 		errors:              errors,
 		transactions:        transactions,
-		deviceTimeouts:      deviceTimeouts,
+		failureInterval:     10 * time.Second,
+		maxBackoff:          30 * time.Minute,
+		presenceWindow:      time.Minute,
+		adapterIDs:          []int{-1},
+		maxConnections:      1,
+		sightings:           make(map[string]map[*adapter]*sighting),
+		sessions:            make(map[string]*session),
+		beacons:             newBeaconTracker(),
+	}
+	for _, opt := range opts {
+		opt(ble)
 	}
 
-	// Register handlers.
-	d.Handle(
-		gatt.PeripheralDiscovered(genOnPeriphDiscoveredCbk(ble)),
-		gatt.PeripheralConnected(genOnPeriphConnectedCbk(ble)),
-		gatt.PeripheralDisconnected(genOnPeriphDisconnectedCbk(ble)),
-	)
+	sched, err := newScheduler(database,
+		time.Duration(deviceConnInterval)*time.Microsecond, ble.failureInterval, ble.maxBackoff)
+	if err != nil {
+		return nil, err
+	}
+	ble.scheduler = sched
 
-	d.Init(func(d gatt.Device, s gatt.State) {
-		switch s {
-		case gatt.StatePoweredOn:
-			d.Scan([]gatt.UUID{}, true)
-			return
-		default:
-			d.StopScanning()
+	pres, err := newPresence(database, ble.presenceWindow)
+	if err != nil {
+		return nil, err
+	}
+	ble.presence = pres
+
+	if ble.discoveryEnabled {
+		disc, err := newDiscovery(database)
+		if err != nil {
+			return nil, err
 		}
-	})
+		ble.discovery = disc
+	}
+
+	err = ble.RefreshWhitelist()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, id := range ble.adapterIDs {
+		d, err := gatt.NewDevice(
+			gatt.LnxMaxConnections(ble.maxConnections),
+			gatt.LnxDeviceID(id, true),
+		)
+		if err != nil {
+			logger.Errorf("Failed to open device hci%d, err: %s\n", id, err)
+			return nil, err
+		}
+		a := &adapter{
+			id:       id,
+			device:   d,
+			maxConns: ble.maxConnections,
+		}
+		ble.adapters = append(ble.adapters, a)
+
+		// Register handlers.
+		d.Handle(
+			gatt.PeripheralDiscovered(genOnPeriphDiscoveredCbk(ble, a)),
+			gatt.PeripheralConnected(genOnPeriphConnectedCbk(ble)),
+			gatt.PeripheralDisconnected(genOnPeriphDisconnectedCbk(ble, a)),
+		)
+	}
+
+	for _, a := range ble.adapters {
+		a := a
+		a.device.Init(func(d gatt.Device, s gatt.State) {
+			ble.mu.Lock()
+			defer ble.mu.Unlock()
+			switch s {
+			case gatt.StatePoweredOn:
+				a.startScan()
+				return
+			default:
+				a.stopScan()
+			}
+		})
+	}
 
 	return ble, nil
 }
 
-func genOnPeriphDiscoveredCbk(ble *MoecoBLE) func(p gatt.Peripheral, a *gatt.Advertisement, rssi int) {
-	return func(p gatt.Peripheral, a *gatt.Advertisement, rssi int) {
-		ble.log.Debugf("\nFound... Peripheral ID:%s, NAME:(%s)\n", p.ID(), p.Name())
+// Presence returns the last seen time, smoothed RSSI, advertisement count and
+// last successful session of every whitelisted device heard so far.
+func (ble *MoecoBLE) Presence() []db.Presence {
+	return ble.presence.snapshot()
+}
 
-		devices, err := ble.db.GetDevices()
-		if err != nil {
-			*ble.errors <- err
-			return
-		}
+// Discovered returns the peripherals heard recently which aren't
+// whitelisted, nil unless the discovery mode is on.
+func (ble *MoecoBLE) Discovered() []db.Discovered {
+	if ble.discovery == nil {
+		return nil
+	}
+	return ble.discovery.snapshot()
+}
+
+func genOnPeriphDiscoveredCbk(ble *MoecoBLE, a *adapter) func(p gatt.Peripheral, adv *gatt.Advertisement, rssi int) {
+	return func(p gatt.Peripheral, adv *gatt.Advertisement, rssi int) {
+		ble.log.Debugf("\nFound on %s... Peripheral ID:%s, NAME:(%s)\n", a, p.ID(), p.Name())
+
+		devices, groups := ble.cachedWhitelist()
 
+		beacons := parseBeacons(adv)
 		for _, device := range devices {
-			if strings.EqualFold(p.ID(), device.Hash) {
-				// not connect to device before timeout
-				timeout, ok := ble.deviceTimeouts[p.ID()]
-				if ok && timeout.After(time.Now()) {
-					return
-				}
+			settings := groups[strings.ToLower(device.DeviceGroupID)]
+			owned := matchAdvertisement(device, settings.Match, p.ID(), adv)
 
-				ble.log.Infof("Peripheral found in whitelist ID: %s, Name: %s\n", p.ID(), p.Name())
-				// Stop scanning once we've got one of the peripherals we're looking for.
-				p.Device().StopScanning()
+			// beacon-only groups are never connected
+			if settings.Beacon != nil {
+				frames, ok := ble.beacons.match(device.Hash, p.ID(), owned, beacons)
+				if !ok {
+					continue
+				}
+				ble.presence.seen(device.Hash, rssi)
+				ble.sendBeacons(device, p.ID(), frames, rssi, *settings.Beacon)
+				return
+			}
 
-				// now we can connect
-				p.Device().Connect(p)
+			if owned {
+				ble.presence.seen(device.Hash, rssi)
+				ble.startSession(a, device, p, rssi)
 				return
 			}
 		}
 
 		ble.log.Debugf("Peripheral not found in whitelist ID: %s, Name: %s\n", p.ID(), p.Name())
+		if ble.discovery != nil {
+			ble.discovery.seen(p, adv, rssi)
+		}
+	}
+}
+
+// startSession connects the device through the adapter which heard it best,
+// unless a session is already held or the device isn't due yet.
+func (ble *MoecoBLE) startSession(a *adapter, device db.Device, p gatt.Peripheral, rssi int) {
+	ble.mu.Lock()
+	sess := ble.newSession(a, device, p, rssi)
+	ble.mu.Unlock()
+	if sess == nil {
+		return
+	}
+
+	// now we can connect, without ble.mu as Connect waits for the controller
+	sess.adapter.device.Connect(sess.peripheral)
+}
+
+// newSession takes a slot on the adapter for a session with the device, it
+// returns nil when no session is to be started. Must be called with ble.mu
+// held.
+func (ble *MoecoBLE) newSession(a *adapter, device db.Device, p gatt.Peripheral, rssi int) *session {
+	ble.recordSighting(a, device.Hash, p, rssi)
+
+	// one session per device, whichever adapter holds it
+	if _, ok := ble.sessions[device.Hash]; ok {
+		return nil
+	}
+
+	// not connect to device before timeout
+	if !ble.scheduler.ready(device.Hash) {
+		return nil
+	}
+
+	target, s := ble.pickAdapter(device.Hash)
+	if target == nil {
+		return nil
+	}
+
+	ble.log.Infof("Peripheral found in whitelist ID: %s, Name: %s, adapter: %s, RSSI: %d\n",
+		p.ID(), p.Name(), target, s.rssi)
+	sess := &session{
+		adapter:      target,
+		device:       device,
+		peripheral:   s.peripheral,
+		peripheralID: s.peripheral.ID(),
+	}
+	sess.timer = time.AfterFunc(connectTimeout, func() {
+		ble.connectTimedOut(device.Hash, sess)
+	})
+	ble.sessions[device.Hash] = sess
+	target.sessions++
+	// Stop scanning once the adapter can't take any more sessions.
+	if target.full() {
+		target.stopScan()
+	}
+	return sess
+}
+
+// connectTimedOut ends the session if its connection still isn't
+// established, a failed LE Create Connection gets no callback otherwise.
+func (ble *MoecoBLE) connectTimedOut(hash string, s *session) {
+	ble.mu.Lock()
+	pending := ble.sessions[hash] == s && !s.connected
+	if pending {
+		ble.log.Warnf("Connection to %s on %s timed out\n", s.peripheralID, s.adapter)
+		ble.endSession(hash, s)
+	}
+	ble.mu.Unlock()
+
+	// recorded once ble.mu is released, as it may block on the errors channel
+	if pending {
+		ble.recordOutcome(s.device, fmt.Errorf("connection timed out"))
+	}
+}
+
+// sessionFor returns the session started for the peripheral, if any.
+func (ble *MoecoBLE) sessionFor(p gatt.Peripheral) *session {
+	ble.mu.Lock()
+	defer ble.mu.Unlock()
+	for _, s := range ble.sessions {
+		if s.adapter.device == p.Device() && strings.EqualFold(s.peripheralID, p.ID()) {
+			s.connected = true
+			s.timer.Stop()
+			return s
+		}
+	}
+	return nil
+}
+
+// endSession releases the adapter slot held by the session. Must be called
+// with ble.mu held.
+func (ble *MoecoBLE) endSession(hash string, s *session) {
+	if ble.sessions[hash] != s {
+		return
+	}
+	delete(ble.sessions, hash)
+	s.timer.Stop()
+	s.adapter.sessions--
+	if !s.connected {
+		// abort the pending LE Create Connection
+		s.adapter.device.Option(gatt.LnxSendHCIRawCommand(cmd.LECreateConnCancel{}, nil))
+	}
+	s.adapter.startScan()
+}
+
+// recordOutcome schedules the next session with the device depending on
+// whether the last one failed. Must not be called with ble.mu held, errors
+// are sent on the unbuffered channel.
+func (ble *MoecoBLE) recordOutcome(device db.Device, sessErr error) {
+	settings := ble.groupSettings(device)
+
+	var err error
+	if sessErr != nil {
+		err = ble.scheduler.failed(device.Hash, settings)
+	} else {
+		ble.presence.sessionSucceeded(device.Hash)
+		err = ble.scheduler.succeeded(device.Hash, settings)
+	}
+	if err != nil {
+		*ble.errors <- err
+	}
+}
+
+// groupSettings returns the settings of the device group, the defaults when
+// the group isn't known.
+func (ble *MoecoBLE) groupSettings(device db.Device) prot.DeviceGroupSettings {
+	_, groups := ble.cachedWhitelist()
+	return groups[strings.ToLower(device.DeviceGroupID)]
+}
+
+// RefreshWhitelist reloads the whitelisted devices and the settings of their
+// groups, which are cached as they are needed for every advertisement. It
+// must be called whenever the registry sync changes them.
+func (ble *MoecoBLE) RefreshWhitelist() error {
+	devices, err := ble.db.GetDevices()
+	if err != nil {
+		return err
+	}
+	groups, err := ble.groupsSettings()
+	if err != nil {
+		return err
+	}
+	ble.whitelistMu.Lock()
+	defer ble.whitelistMu.Unlock()
+	ble.whitelist = devices
+	ble.groups = groups
+	return nil
+}
+
+func (ble *MoecoBLE) cachedWhitelist() ([]db.Device, map[string]prot.DeviceGroupSettings) {
+	ble.whitelistMu.RLock()
+	defer ble.whitelistMu.RUnlock()
+	return ble.whitelist, ble.groups
+}
+
+// groupsSettings returns the settings of all device groups by lowercased ID.
+func (ble *MoecoBLE) groupsSettings() (map[string]prot.DeviceGroupSettings, error) {
+	deviceGroups, err := ble.db.GetDeviceGroups()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]prot.DeviceGroupSettings, len(deviceGroups))
+	for _, deviceGroupDB := range deviceGroups {
+		deviceGroup, err := types.DeviceGroupToResponse(deviceGroupDB)
+		if err != nil {
+			return nil, err
+		}
+		res[strings.ToLower(deviceGroupDB.ExonumID)] = deviceGroup.Settings
 	}
+	return res, nil
 }
 
 func genOnPeriphConnectedCbk(ble *MoecoBLE) func(p gatt.Peripheral, err error) {
@@ -115,112 +432,158 @@ func genOnPeriphConnectedCbk(ble *MoecoBLE) func(p gatt.Peripheral, err error) {
 			*ble.errors <- fmt.Errorf("failed to set MTU, err: %s\n", err)
 		}
 
-		device, err := ble.db.GetDeviceByHash(p.ID())
-		if err != nil {
-			*ble.errors <- err
-			return
-		}
-		if device == nil {
+		sess := ble.sessionFor(p)
+		if sess == nil {
 			*ble.errors <- fmt.Errorf("already connected device not found in whitelist ID: %s\n", p.ID())
 			return
 		}
+		device := sess.device
+
+		// the first connect/discovery error fails the session
+		var sessErr error
+		defer func() {
+			ble.recordOutcome(device, sessErr)
+		}()
 
 		deviceGroupDB, err := ble.db.GetDeviceGroupByID(device.DeviceGroupID)
 		if err != nil {
+			sessErr = err
 			*ble.errors <- err
 			return
 		}
 		if deviceGroupDB == nil {
-			*ble.errors <- fmt.Errorf("device group not found for device with ID: %s, device group ID: %s\n", p.ID(), device.DeviceGroupID)
+			sessErr = fmt.Errorf("device group not found for device with ID: %s, device group ID: %s\n", p.ID(), device.DeviceGroupID)
+			*ble.errors <- sessErr
 			return
 		}
 
 		deviceGroup, err := types.DeviceGroupToResponse(*deviceGroupDB)
 		if err != nil {
+			sessErr = err
 			*ble.errors <- err
 			return
 		}
 
-		// Discovery device services
-		pServices, err := p.DiscoverServices(nil)
+		// Discovery device services or take them from the cache
+		services, firmware, cached, err := ble.attributes(p, device)
 		if err != nil {
-			ble.log.Errorf("failed to discover services, err: %s\n", err)
+			sessErr = err
+			ble.log.Errorf("failed to discover attributes, err: %s\n", err)
 			return
 		}
+		// The first failed operation invalidates the cached attributes
+		defer func() {
+			if cached && sessErr != nil {
+				ble.invalidateAttributes(device)
+			}
+		}()
+		ble.watchServiceChanged(p, services, device)
+		ble.updateDeviceInfo(p, services, device, firmware)
 
-		payload := make(map[string]map[string]string)
+		payload := newPayload()
 
-		for _, pService := range pServices {
-			var dgService *prot.Service = nil
-			for _, s := range deviceGroup.Services {
-				name := strings.Replace(s.Name, "-", "", -1)
-				if strings.EqualFold(pService.UUID().String(), name) {
-					dgService = &s
-					break
+		// Scripted steps some devices need before they expose their data
+		if len(deviceGroup.Settings.Procedure) > 0 {
+			err := runProcedure(p, services, deviceGroup.Settings.Procedure, payload)
+			if err != nil {
+				if sessErr == nil {
+					sessErr = err
 				}
+				ble.log.Errorf("%s\n", err)
 			}
-			if dgService == nil {
-				continue
+		}
+
+		// Set the device clock, if the group wants it
+		if deviceGroup.Settings.TimeSync != nil {
+			err := syncTime(p, services, *deviceGroup.Settings.TimeSync, payload)
+			if err != nil {
+				if sessErr == nil {
+					sessErr = err
+				}
+				ble.log.Errorf("time sync with %s failed, err: %s\n", device.Hash, err)
 			}
+		}
 
-			// Discovery characteristics
-			cs, err := p.DiscoverCharacteristics(nil, pService)
+		// Framed protocol over UART characteristics, frames arrive until
+		// the session ends
+		if deviceGroup.Settings.UART != nil {
+			err := ble.runUART(p, services, device, *deviceGroup.Settings.UART, payload)
 			if err != nil {
-				ble.log.Errorf("failed to discover characteristics, err: %s\n", err)
+				if sessErr == nil {
+					sessErr = err
+				}
+				ble.log.Errorf("uart with %s failed, err: %s\n", device.Hash, err)
+			}
+		}
+
+		for _, dgService := range deviceGroup.Services {
+			var pService *gatt.Service
+			for _, s := range services {
+				if matchesUUID(s.UUID(), dgService.Name) {
+					pService = s
+					break
+				}
+			}
+			if pService == nil {
+				for _, dgChar := range dgService.Characteristics {
+					payload.diagnose(dgService.Name, dgChar.Name, "service not found on device")
+				}
 				continue
 			}
 
-			for _, pChar := range cs {
-				var dgChar *prot.Characteristic
-				for _, c := range dgService.Characteristics {
-					name := strings.Replace(c.Name, "-", "", -1)
-					if strings.EqualFold(pChar.UUID().String(), name) {
-						dgChar = &c
+			for _, dgChar := range dgService.Characteristics {
+				var pChar *gatt.Characteristic
+				for _, c := range pService.Characteristics() {
+					if matchesUUID(c.UUID(), dgChar.Name) {
+						pChar = c
 						break
 					}
 				}
-				if dgChar == nil {
+				if pChar == nil {
+					payload.diagnose(dgService.Name, dgChar.Name, "characteristic not found on device")
 					continue
 				}
+				serviceName, charName, authenticated := dgService.Name, dgChar.Name, dgChar.Mac
+				record := func(b []byte) {
+					ble.recordValue(payload, deviceGroup.Settings, device, serviceName, charName, authenticated, b, time.Now())
+				}
+
+				props := pChar.Properties()
+				if dgChar.Readable && (props&gatt.CharRead) == 0 {
+					payload.diagnose(serviceName, charName, "defined readable, device doesn't support read")
+				}
+				if dgChar.Notifiable && (props&(gatt.CharNotify|gatt.CharIndicate)) == 0 {
+					payload.diagnose(serviceName, charName, "defined notifiable, device doesn't support notify or indicate")
+				}
+				if dgChar.Writable && (props&(gatt.CharWrite|gatt.CharWriteNR)) == 0 {
+					payload.diagnose(serviceName, charName, "defined writable, device doesn't support write")
+				}
 
-				// Read the characteristic, if possible.
-				if (pChar.Properties() & gatt.CharRead) != 0 {
+				// Read the characteristic, if defined and possible.
+				if dgChar.Readable && (props&gatt.CharRead) != 0 {
 					b, err := p.ReadLongCharacteristic(pChar)
 					if err != nil {
+						if sessErr == nil {
+							sessErr = err
+						}
 						ble.log.Errorf("failed to read characteristic, err: %s\n", err)
+						payload.diagnose(serviceName, charName, "read failed: "+err.Error())
 						continue
 					}
-
-					// init map if is not yet allocated
-					_, ok := payload[dgService.Name]
-					if !ok {
-						payload[dgService.Name] = make(map[string]string)
-					}
-					payload[dgService.Name][dgChar.Name] = hex.EncodeToString(b)
-				}
-
-				/*
-				 * It's needed to discover descriptors *before*
-				 * attempting to subscribe to characteristic
-				 */
-				_, err := p.DiscoverDescriptors(nil, pChar)
-				if err != nil {
-					ble.log.Warn("failed to discover descriptors, err: %s\n", err)
-					continue
+					record(b)
 				}
 
-				// Subscribe the characteristic, if possible.
-				if (pChar.Properties() & (gatt.CharNotify | gatt.CharIndicate)) != 0 {
+				// Subscribe the characteristic, if defined and possible.
+				if dgChar.Notifiable && (props&(gatt.CharNotify|gatt.CharIndicate)) != 0 {
 					f := func(c *gatt.Characteristic, b []byte, err error) {
-						// init map if is not yet allocated
-						_, ok := payload[dgService.Name]
-						if !ok {
-							payload[dgService.Name] = make(map[string]string)
-						}
-						payload[dgService.Name][dgChar.Name] = hex.EncodeToString(b)
+						record(b)
 					}
 					if err := p.SetNotifyValue(pChar, f); err != nil {
+						if sessErr == nil {
+							sessErr = err
+						}
 						ble.log.Errorf("failed to subscribe characteristic, err: %s\n", err)
+						payload.diagnose(serviceName, charName, "subscribe failed: "+err.Error())
 						continue
 					}
 				}
@@ -231,12 +594,12 @@ func genOnPeriphConnectedCbk(ble *MoecoBLE) func(p gatt.Peripheral, err error) {
 		time.Sleep(time.Duration(ble.charNotifyInterval) * time.Microsecond)
 
 		// Prepare transaction and put it on channel
-		b, err := json.Marshal(payload)
+		b, err := payload.marshal()
 		ble.log.Debugf("payload: %s\n", b);
 		*ble.transactions <- db.Transaction{
 			Hash:       "",
 			DeviceHash: device.Hash,
-			Timestamp:  int(time.Now().Unix()), // FIXME: truncating int64->int32
+			Timestamp:  db.Timestamp(time.Now()),
 			Uplink:     0,
 			Sended:     0,
 			Payload:    string(b),
@@ -244,15 +607,53 @@ func genOnPeriphConnectedCbk(ble *MoecoBLE) func(p gatt.Peripheral, err error) {
 	}
 }
 
-func genOnPeriphDisconnectedCbk(ble *MoecoBLE) func(p gatt.Peripheral, err error) {
-	return func(p gatt.Peripheral, err error) {
-		// init device timeout
-		ble.deviceTimeouts[p.ID()] = time.Now().Add(time.Duration(ble.deviceConnInterval) * time.Microsecond)
+// recordValue puts a characteristic value received at the given time into
+// the payload. Values of authenticated characteristics are verified first,
+// with the outcome recorded in the mac section.
+func (ble *MoecoBLE) recordValue(payload *payload, settings prot.DeviceGroupSettings, device db.Device,
+	service, char string, authenticated bool, b []byte, at time.Time) {
+	if authenticated {
+		data, outcome, err := verifyMac(settings.Mac, device.MacKey, b)
+		if err != nil {
+			ble.log.Errorf("failed to verify mac of %s/%s, err: %s\n", service, char, err)
+		}
+		payload.set(macSection, service+"/"+char, outcome)
+		if outcome != macOK && settings.Mac.DropUnauthenticated {
+			ble.log.Warnf("Dropped unauthenticated value of %s/%s from %s\n", service, char, device.Hash)
+			return
+		}
+		b = data
+	}
+	payload.set(service, char, hex.EncodeToString(b))
+	payload.set(timestampsSection, service+"/"+char, strconv.FormatInt(db.Timestamp(at), 10))
 
-		//delete(m.deviceTimeouts, p.ID())
-		ble.log.Infof("Disconnected from %s\n", p.ID())
-		// turn on scan
-		p.Device().Scan([]gatt.UUID{}, true)
+	decode := decoderFor(char)
+	if decode == nil {
+		return
+	}
+	fields, err := decode(b)
+	if err != nil {
+		payload.diagnose(service, char, "failed to decode: "+err.Error())
+		return
+	}
+	for field, value := range fields {
+		payload.set(service, char+"."+field, value)
 	}
 }
 
+func genOnPeriphDisconnectedCbk(ble *MoecoBLE, a *adapter) func(p gatt.Peripheral, err error) {
+	return func(p gatt.Peripheral, err error) {
+		ble.mu.Lock()
+		defer ble.mu.Unlock()
+
+		for hash, s := range ble.sessions {
+			if s.adapter != a || !strings.EqualFold(s.peripheralID, p.ID()) {
+				continue
+			}
+			// release the adapter and turn on scan
+			ble.endSession(hash, s)
+		}
+
+		ble.log.Infof("Disconnected from %s on %s\n", p.ID(), a)
+	}
+}
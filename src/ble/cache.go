@@ -0,0 +1,240 @@
+package ble
+
+import (
+	"db"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/mihalicyn/gatt"
+)
+
+var (
+	attrGATTUUID           = gatt.UUID16(0x1801)
+	attrServiceChangedUUID = gatt.UUID16(0x2A05)
+	attrCCCDUUID           = gatt.UUID16(0x2902)
+	attrDeviceInfoUUID     = gatt.UUID16(0x180A)
+	attrFirmwareRevUUID    = gatt.UUID16(0x2A26)
+)
+
+type cachedService struct {
+	UUID            string                 `json:"uuid"`
+	Handle          uint16                 `json:"handle"`
+	EndHandle       uint16                 `json:"end_handle"`
+	Characteristics []cachedCharacteristic `json:"characteristics"`
+}
+
+type cachedCharacteristic struct {
+	UUID       string `json:"uuid"`
+	Properties uint8  `json:"properties"`
+	Handle     uint16 `json:"handle"`
+	VHandle    uint16 `json:"value_handle"`
+	EndHandle  uint16 `json:"end_handle"`
+	CCCD       uint16 `json:"cccd"`
+}
+
+// discoverAttributes walks the whole attribute table of the peripheral. The
+// client characteristic configuration descriptors are only looked up for
+// characteristics that can notify or indicate. Services and characteristics
+// failing discovery are skipped, the table is then incomplete and shouldn't
+// be cached.
+func (ble *MoecoBLE) discoverAttributes(p gatt.Peripheral) (services []*gatt.Service, complete bool, err error) {
+	pServices, err := p.DiscoverServices(nil)
+	if err != nil {
+		return nil, false, err
+	}
+	complete = true
+	for _, pService := range pServices {
+		cs, err := p.DiscoverCharacteristics(nil, pService)
+		if err != nil {
+			ble.log.Warnf("failed to discover characteristics of service %s on %s, err: %s\n",
+				pService.UUID(), p.ID(), err)
+			complete = false
+			continue
+		}
+		for _, pChar := range cs {
+			if (pChar.Properties() & (gatt.CharNotify | gatt.CharIndicate)) == 0 {
+				continue
+			}
+			/*
+			 * It's needed to discover descriptors *before*
+			 * attempting to subscribe to characteristic
+			 */
+			_, err := p.DiscoverDescriptors(nil, pChar)
+			if err != nil {
+				ble.log.Warnf("failed to discover descriptors of characteristic %s on %s, err: %s\n",
+					pChar.UUID(), p.ID(), err)
+				complete = false
+			}
+		}
+		services = append(services, pService)
+	}
+	return services, complete, nil
+}
+
+func encodeAttributes(services []*gatt.Service) (string, error) {
+	cache := make([]cachedService, 0, len(services))
+	for _, s := range services {
+		cs := cachedService{
+			UUID:      s.UUID().String(),
+			Handle:    s.Handle(),
+			EndHandle: s.EndHandle(),
+		}
+		for _, c := range s.Characteristics() {
+			cc := cachedCharacteristic{
+				UUID:       c.UUID().String(),
+				Properties: uint8(c.Properties()),
+				Handle:     c.Handle(),
+				VHandle:    c.VHandle(),
+				EndHandle:  c.EndHandle(),
+			}
+			if c.Descriptor() != nil {
+				cc.CCCD = c.Descriptor().Handle()
+			}
+			cs.Characteristics = append(cs.Characteristics, cc)
+		}
+		cache = append(cache, cs)
+	}
+	b, err := json.Marshal(cache)
+	return string(b), err
+}
+
+func decodeAttributes(attributes string) ([]*gatt.Service, error) {
+	var cache []cachedService
+	err := json.Unmarshal([]byte(attributes), &cache)
+	if err != nil {
+		return nil, err
+	}
+	services := make([]*gatt.Service, 0, len(cache))
+	for _, cs := range cache {
+		u, err := gatt.ParseUUID(cs.UUID)
+		if err != nil {
+			return nil, err
+		}
+		s := gatt.NewService(u)
+		s.SetHandle(cs.Handle)
+		s.SetEndHandle(cs.EndHandle)
+		chars := make([]*gatt.Characteristic, 0, len(cs.Characteristics))
+		for _, cc := range cs.Characteristics {
+			u, err := gatt.ParseUUID(cc.UUID)
+			if err != nil {
+				return nil, err
+			}
+			c := gatt.NewCharacteristic(u, s, gatt.Property(cc.Properties), cc.Handle, cc.VHandle)
+			c.SetEndHandle(cc.EndHandle)
+			if cc.CCCD != 0 {
+				c.SetDescriptor(gatt.NewDescriptor(attrCCCDUUID, cc.CCCD, c))
+			}
+			chars = append(chars, c)
+		}
+		s.SetCharacteristics(chars)
+		services = append(services, s)
+	}
+	return services, nil
+}
+
+// findCharacteristic looks the characteristic up in the attribute table.
+func findCharacteristic(services []*gatt.Service, service, char gatt.UUID) *gatt.Characteristic {
+	for _, s := range services {
+		if !s.UUID().Equal(service) {
+			continue
+		}
+		for _, c := range s.Characteristics() {
+			if c.UUID().Equal(char) {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+// readFirmware reads the firmware revision from the Device Information
+// service, if the device has one.
+func readFirmware(p gatt.Peripheral, services []*gatt.Service) (string, error) {
+	c := findCharacteristic(services, attrDeviceInfoUUID, attrFirmwareRevUUID)
+	if c == nil {
+		return "", nil
+	}
+	b, err := p.ReadCharacteristic(c)
+	if err != nil {
+		return "", err
+	}
+	// some devices pad the revision string to the characteristic length
+	return strings.TrimRight(string(b), "\x00"), nil
+}
+
+// attributes returns the attribute table of the device, from the cache when
+// it is still valid or by discovering it otherwise. The firmware revision
+// read while validating the cache is returned as well.
+func (ble *MoecoBLE) attributes(p gatt.Peripheral, device db.Device) (services []*gatt.Service, firmware string, cached bool, err error) {
+	cache, err := ble.db.GetGattCache(device.Hash)
+	if err != nil {
+		return nil, "", false, err
+	}
+	if cache != nil {
+		services, err = decodeAttributes(cache.Attributes)
+		if err == nil {
+			firmware, err = readFirmware(p, services)
+		}
+		if err == nil && firmware == cache.Firmware {
+			return services, firmware, true, nil
+		}
+		if err != nil {
+			ble.log.Warnf("GATT cache of %s is not usable, err: %s\n", device.Hash, err)
+		} else {
+			ble.log.Infof("Firmware of %s changed from %q to %q\n", device.Hash, cache.Firmware, firmware)
+		}
+		ble.invalidateAttributes(device)
+	}
+
+	services, complete, err := ble.discoverAttributes(p)
+	if err != nil {
+		return nil, "", false, err
+	}
+	firmware, err = readFirmware(p, services)
+	if err != nil {
+		return nil, "", false, err
+	}
+	if !complete {
+		// discovered again with the next session
+		return services, firmware, false, nil
+	}
+	attributes, err := encodeAttributes(services)
+	if err != nil {
+		return nil, "", false, err
+	}
+	err = ble.db.UpsertGattCache(db.GattCache{
+		DeviceHash: device.Hash,
+		Firmware:   firmware,
+		Attributes: attributes,
+		UpdatedAt:  int(time.Now().Unix()),
+	})
+	if err != nil {
+		*ble.errors <- err
+	}
+	return services, firmware, false, nil
+}
+
+// invalidateAttributes drops the cached attribute table of the device.
+func (ble *MoecoBLE) invalidateAttributes(device db.Device) {
+	err := ble.db.DeleteGattCache(device.Hash)
+	if err != nil {
+		*ble.errors <- err
+	}
+}
+
+// watchServiceChanged invalidates the cache when the device indicates that
+// its attribute table changed.
+func (ble *MoecoBLE) watchServiceChanged(p gatt.Peripheral, services []*gatt.Service, device db.Device) {
+	c := findCharacteristic(services, attrGATTUUID, attrServiceChangedUUID)
+	if c == nil || c.Descriptor() == nil {
+		return
+	}
+	err := p.SetIndicateValue(c, func(c *gatt.Characteristic, b []byte, err error) {
+		ble.log.Infof("Service Changed indicated by %s\n", device.Hash)
+		ble.invalidateAttributes(device)
+	})
+	if err != nil {
+		ble.log.Warnf("failed to subscribe Service Changed, err: %s\n", err)
+	}
+}
@@ -0,0 +1,300 @@
+package ble
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Decoder turns a characteristic value into named fields. The fields are put
+// into the payload next to the raw value as "<characteristic>.<field>".
+type Decoder func(b []byte) (map[string]string, error)
+
+// bluetoothBaseUUID is the tail of the 128-bit form of 16-bit SIG UUIDs.
+const bluetoothBaseUUID = "00001000800000805f9b34fb"
+
+var (
+	decodersMu sync.RWMutex
+	decoders   = map[string]Decoder{
+		// Battery Service
+		"2a19": decodeUint("battery_level", 1, 0),
+		// Device Information Service
+		"2a23": decodeSystemID,
+		"2a24": decodeString("model_number"),
+		"2a25": decodeString("serial_number"),
+		"2a26": decodeString("firmware_revision"),
+		"2a27": decodeString("hardware_revision"),
+		"2a28": decodeString("software_revision"),
+		"2a29": decodeString("manufacturer_name"),
+		"2a50": decodePnPID,
+		// Environmental Sensing Service
+		"2a6c": decodeSint("elevation", 3, 2),
+		"2a6d": decodeUint("pressure", 4, 1),
+		"2a6e": decodeSint("temperature", 2, 2),
+		"2a6f": decodeUint("humidity", 2, 2),
+		"2a76": decodeUint("uv_index", 1, 0),
+		"2a7b": decodeSint("dew_point", 1, 0),
+		// Heart Rate Service
+		"2a37": decodeHeartRate,
+		"2a38": decodeBodySensorLocation,
+		// Health Thermometer Service
+		"2a1c": decodeTemperatureMeasurement,
+		"2a1d": decodeTemperatureType,
+		"2a1e": decodeTemperatureMeasurement,
+		// Current Time Service
+		"2a2b": decodeCurrentTimeFields,
+	}
+)
+
+// RegisterDecoder registers the decoder for characteristics with the UUID,
+// replacing the built-in one if any.
+func RegisterDecoder(uuid string, d Decoder) {
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+	decoders[normalizeUUID(uuid)] = d
+}
+
+func decoderFor(uuid string) Decoder {
+	decodersMu.RLock()
+	defer decodersMu.RUnlock()
+	return decoders[normalizeUUID(uuid)]
+}
+
+// normalizeUUID lowercases the UUID, drops dashes and shortens SIG UUIDs to
+// their 16-bit form, so that all spellings of a UUID compare equal.
+func normalizeUUID(uuid string) string {
+	u := strings.ToLower(strings.Replace(uuid, "-", "", -1))
+	if len(u) == 32 && strings.HasPrefix(u, "0000") && strings.HasSuffix(u, bluetoothBaseUUID) {
+		return u[4:8]
+	}
+	return u
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// scaled formats v * 10^exponent. Dividing for negative exponents keeps
+// values like 36.98 exact.
+func scaled(v float64, exponent int) string {
+	if exponent < 0 {
+		return formatFloat(v / math.Pow10(-exponent))
+	}
+	return formatFloat(v * math.Pow10(exponent))
+}
+
+// le reads an unsigned little endian integer of up to 4 bytes.
+func le(b []byte, size int) uint32 {
+	var v uint32
+	for i := size - 1; i >= 0; i-- {
+		v = v<<8 | uint32(b[i])
+	}
+	return v
+}
+
+// sle reads a signed little endian integer of up to 4 bytes.
+func sle(b []byte, size int) int32 {
+	v := le(b, size)
+	shift := uint(32 - 8*size)
+	return int32(v<<shift) >> shift
+}
+
+// decodeUint decodes a unsigned little endian integer with the given number
+// of decimal places.
+func decodeUint(name string, size, decimals int) Decoder {
+	return func(b []byte) (map[string]string, error) {
+		if len(b) < size {
+			return nil, fmt.Errorf("%s too short: %d bytes", name, len(b))
+		}
+		return map[string]string{name: scaled(float64(le(b, size)), -decimals)}, nil
+	}
+}
+
+// decodeSint decodes a signed little endian integer with the given number
+// of decimal places.
+func decodeSint(name string, size, decimals int) Decoder {
+	return func(b []byte) (map[string]string, error) {
+		if len(b) < size {
+			return nil, fmt.Errorf("%s too short: %d bytes", name, len(b))
+		}
+		return map[string]string{name: scaled(float64(sle(b, size)), -decimals)}, nil
+	}
+}
+
+func decodeString(name string) Decoder {
+	return func(b []byte) (map[string]string, error) {
+		return map[string]string{name: strings.TrimRight(string(b), "\x00")}, nil
+	}
+}
+
+func decodeSystemID(b []byte) (map[string]string, error) {
+	if len(b) < 8 {
+		return nil, fmt.Errorf("system id too short: %d bytes", len(b))
+	}
+	return map[string]string{
+		"manufacturer_identifier":            fmt.Sprintf("%010x", uint64(le(b[0:4], 4))|uint64(b[4])<<32),
+		"organizationally_unique_identifier": fmt.Sprintf("%06x", le(b[5:8], 3)),
+	}, nil
+}
+
+func decodePnPID(b []byte) (map[string]string, error) {
+	if len(b) < 7 {
+		return nil, fmt.Errorf("pnp id too short: %d bytes", len(b))
+	}
+	source := "unknown"
+	switch b[0] {
+	case 1:
+		source = "bluetooth_sig"
+	case 2:
+		source = "usb_if"
+	}
+	return map[string]string{
+		"vendor_id_source": source,
+		"vendor_id":        fmt.Sprintf("0x%04x", le(b[1:3], 2)),
+		"product_id":       fmt.Sprintf("0x%04x", le(b[3:5], 2)),
+		"product_version":  fmt.Sprintf("0x%04x", le(b[5:7], 2)),
+	}, nil
+}
+
+func decodeHeartRate(b []byte) (map[string]string, error) {
+	if len(b) < 2 {
+		return nil, fmt.Errorf("heart rate measurement too short: %d bytes", len(b))
+	}
+	flags, b := b[0], b[1:]
+	res := make(map[string]string)
+
+	if flags&0x01 != 0 {
+		if len(b) < 2 {
+			return nil, fmt.Errorf("heart rate measurement truncated")
+		}
+		res["heart_rate"] = strconv.Itoa(int(le(b, 2)))
+		b = b[2:]
+	} else {
+		res["heart_rate"] = strconv.Itoa(int(b[0]))
+		b = b[1:]
+	}
+
+	switch (flags >> 1) & 0x03 {
+	case 2:
+		res["sensor_contact"] = "not_detected"
+	case 3:
+		res["sensor_contact"] = "detected"
+	default:
+		res["sensor_contact"] = "unsupported"
+	}
+
+	if flags&0x08 != 0 {
+		if len(b) < 2 {
+			return nil, fmt.Errorf("heart rate measurement truncated")
+		}
+		res["energy_expended"] = strconv.Itoa(int(le(b, 2)))
+		b = b[2:]
+	}
+
+	if flags&0x10 != 0 {
+		var rr []string
+		for ; len(b) >= 2; b = b[2:] {
+			// resolution of 1/1024 second
+			rr = append(rr, formatFloat(float64(le(b, 2))/1024))
+		}
+		res["rr_intervals"] = strings.Join(rr, ",")
+	}
+	return res, nil
+}
+
+var bodySensorLocations = []string{"other", "chest", "wrist", "finger", "hand", "ear_lobe", "foot"}
+
+func decodeBodySensorLocation(b []byte) (map[string]string, error) {
+	if len(b) < 1 {
+		return nil, fmt.Errorf("body sensor location is empty")
+	}
+	location := "unknown"
+	if int(b[0]) < len(bodySensorLocations) {
+		location = bodySensorLocations[b[0]]
+	}
+	return map[string]string{"body_sensor_location": location}, nil
+}
+
+// ieee11073Float decodes the 32-bit FLOAT type of IEEE 11073-20601.
+func ieee11073Float(b []byte) float64 {
+	raw := le(b, 4)
+	switch raw {
+	case 0x007FFFFF, 0x00800000, 0x00800001:
+		return math.NaN()
+	case 0x007FFFFE:
+		return math.Inf(1)
+	case 0x00800002:
+		return math.Inf(-1)
+	}
+	return float64(sle(b, 3)) * math.Pow10(int(int8(b[3])))
+}
+
+func formatIEEE11073Float(b []byte) string {
+	f := ieee11073Float(b)
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return formatFloat(f)
+	}
+	return scaled(float64(sle(b, 3)), int(int8(b[3])))
+}
+
+var temperatureTypes = []string{"", "armpit", "body", "ear", "finger", "gastro_intestinal_tract",
+	"mouth", "rectum", "toe", "tympanum"}
+
+func temperatureType(t byte) string {
+	if t > 0 && int(t) < len(temperatureTypes) {
+		return temperatureTypes[t]
+	}
+	return "unknown"
+}
+
+func decodeTemperatureMeasurement(b []byte) (map[string]string, error) {
+	if len(b) < 5 {
+		return nil, fmt.Errorf("temperature measurement too short: %d bytes", len(b))
+	}
+	flags := b[0]
+	res := map[string]string{
+		"temperature": formatIEEE11073Float(b[1:5]),
+		"unit":        "celsius",
+	}
+	if flags&0x01 != 0 {
+		res["unit"] = "fahrenheit"
+	}
+	b = b[5:]
+	if flags&0x02 != 0 {
+		if len(b) < 7 {
+			return nil, fmt.Errorf("temperature measurement truncated")
+		}
+		t, err := decodeCurrentTime(b[:7])
+		if err != nil {
+			return nil, err
+		}
+		res["timestamp"] = t.Format(time.RFC3339)
+		b = b[7:]
+	}
+	if flags&0x04 != 0 && len(b) >= 1 {
+		res["temperature_type"] = temperatureType(b[0])
+	}
+	return res, nil
+}
+
+func decodeTemperatureType(b []byte) (map[string]string, error) {
+	if len(b) < 1 {
+		return nil, fmt.Errorf("temperature type is empty")
+	}
+	return map[string]string{"temperature_type": temperatureType(b[0])}, nil
+}
+
+func decodeCurrentTimeFields(b []byte) (map[string]string, error) {
+	t, err := decodeCurrentTime(b)
+	if err != nil {
+		return nil, err
+	}
+	res := map[string]string{"time": t.Format(time.RFC3339Nano)}
+	if len(b) >= 10 {
+		res["adjust_reason"] = fmt.Sprintf("0x%02x", b[9])
+	}
+	return res, nil
+}
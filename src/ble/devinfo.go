@@ -0,0 +1,84 @@
+package ble
+
+import (
+	"db"
+	"strings"
+	"time"
+
+	"github.com/mihalicyn/gatt"
+)
+
+var (
+	attrBatteryServiceUUID   = gatt.UUID16(0x180F)
+	attrBatteryLevelUUID     = gatt.UUID16(0x2A19)
+	attrManufacturerNameUUID = gatt.UUID16(0x2A29)
+	attrModelNumberUUID      = gatt.UUID16(0x2A24)
+	attrSerialNumberUUID     = gatt.UUID16(0x2A25)
+	attrHardwareRevUUID      = gatt.UUID16(0x2A27)
+	attrSoftwareRevUUID      = gatt.UUID16(0x2A28)
+)
+
+// updateDeviceInfo records the session in the device registry. The Device
+// Information Service is read again only when the firmware revision differs
+// from the stored one, the battery level on every session.
+func (ble *MoecoBLE) updateDeviceInfo(p gatt.Peripheral, services []*gatt.Service, device db.Device, firmware string) {
+	now := int(time.Now().Unix())
+
+	if hasService(services, attrDeviceInfoUUID) && (device.InfoUpdatedAt == 0 || firmware != device.FirmwareRevision) {
+		info := device
+		info.FirmwareRevision = firmware
+		for _, f := range []struct {
+			uuid  gatt.UUID
+			value *string
+		}{
+			{attrManufacturerNameUUID, &info.ManufacturerName},
+			{attrModelNumberUUID, &info.ModelNumber},
+			{attrSerialNumberUUID, &info.SerialNumber},
+			{attrHardwareRevUUID, &info.HardwareRevision},
+			{attrSoftwareRevUUID, &info.SoftwareRevision},
+		} {
+			c := findCharacteristic(services, attrDeviceInfoUUID, f.uuid)
+			if c == nil {
+				continue
+			}
+			b, err := p.ReadCharacteristic(c)
+			if err != nil {
+				ble.log.Errorf("failed to read %s of %s, err: %s\n", f.uuid, device.Hash, err)
+				continue
+			}
+			*f.value = strings.TrimRight(string(b), "\x00")
+		}
+		info.InfoUpdatedAt = now
+		err := ble.db.UpdateDeviceInfo(info)
+		if err != nil {
+			*ble.errors <- err
+		} else {
+			ble.log.Infof("Device info of %s: model %q, serial %q, firmware %q\n",
+				device.Hash, info.ModelNumber, info.SerialNumber, info.FirmwareRevision)
+		}
+	}
+
+	battery := -1
+	c := findCharacteristic(services, attrBatteryServiceUUID, attrBatteryLevelUUID)
+	if c != nil && (c.Properties()&gatt.CharRead) != 0 {
+		b, err := p.ReadCharacteristic(c)
+		if err != nil {
+			ble.log.Errorf("failed to read battery level of %s, err: %s\n", device.Hash, err)
+		} else if len(b) > 0 {
+			battery = int(b[0])
+		}
+	}
+	err := ble.db.UpdateDeviceSession(device.Hash, now, battery)
+	if err != nil {
+		*ble.errors <- err
+	}
+}
+
+func hasService(services []*gatt.Service, u gatt.UUID) bool {
+	for _, s := range services {
+		if s.UUID().Equal(u) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,100 @@
+package ble
+
+import (
+	"db"
+	"encoding/binary"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mihalicyn/gatt"
+)
+
+const (
+	// maxDiscovered bounds the devices kept by the discovery mode, so a
+	// crowded place can't exhaust the gateway memory.
+	maxDiscovered = 1000
+	// discoveryTTL is how long a device stays listed after it was last heard.
+	discoveryTTL = time.Hour
+)
+
+// discovery aggregates the advertisements of peripherals which aren't
+// whitelisted, for installers to claim them.
+type discovery struct {
+	mu      sync.Mutex
+	entries map[string]*db.Discovered
+}
+
+func newDiscovery(database *db.DBAdapter) (*discovery, error) {
+	discovered, err := database.GetDiscovered()
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]*db.Discovered, len(discovered))
+	for i := range discovered {
+		entries[discovered[i].Address] = &discovered[i]
+	}
+	return &discovery{entries: entries}, nil
+}
+
+// seen records an advertisement of a peripheral not in the whitelist.
+func (d *discovery) seen(p gatt.Peripheral, adv *gatt.Advertisement, rssi int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := int(time.Now().Unix())
+	e, ok := d.entries[p.ID()]
+	if !ok {
+		if len(d.entries) >= maxDiscovered {
+			d.expire(now)
+			if len(d.entries) >= maxDiscovered {
+				return
+			}
+		}
+		e = &db.Discovered{Address: p.ID(), CompanyID: -1, FirstSeen: now}
+		d.entries[p.ID()] = e
+	}
+	e.AdvCount++
+	e.LastSeen = now
+	e.RSSI = rssi
+	// scan responses may carry the name or the services only
+	if adv.LocalName != "" {
+		e.Name = adv.LocalName
+	}
+	if len(adv.ManufacturerData) >= 2 {
+		e.CompanyID = int(binary.LittleEndian.Uint16(adv.ManufacturerData[0:2]))
+	}
+	if len(adv.Services) > 0 {
+		services := strings.Split(e.Services, ",")
+		if e.Services == "" {
+			services = nil
+		}
+		for _, u := range adv.Services {
+			if !containsString(services, u.String()) {
+				services = append(services, u.String())
+			}
+		}
+		sort.Strings(services)
+		e.Services = strings.Join(services, ",")
+	}
+}
+
+// expire drops the devices not heard for discoveryTTL.
+func (d *discovery) expire(now int) {
+	for address, e := range d.entries {
+		if now-e.LastSeen > int(discoveryTTL/time.Second) {
+			delete(d.entries, address)
+		}
+	}
+}
+
+func (d *discovery) snapshot() []db.Discovered {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.expire(int(time.Now().Unix()))
+	res := make([]db.Discovered, 0, len(d.entries))
+	for _, e := range d.entries {
+		res = append(res, *e)
+	}
+	return res
+}
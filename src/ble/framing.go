@@ -0,0 +1,254 @@
+package ble
+
+import (
+	"bytes"
+	"clients/prot"
+	"encoding/binary"
+	"fmt"
+)
+
+const defaultMaxFrame = 4096
+
+// framer splits a byte stream into frames and frames outgoing requests.
+type framer interface {
+	// feed appends received bytes and returns the frames they complete.
+	feed(b []byte) [][]byte
+	encode(frame []byte) []byte
+}
+
+func newFramer(settings prot.UARTSettings) (framer, error) {
+	maxFrame := settings.MaxFrame
+	if maxFrame <= 0 {
+		maxFrame = defaultMaxFrame
+	}
+	switch settings.Framing {
+	case prot.FramingLengthPrefixed:
+		size := settings.LengthSize
+		if size == 0 {
+			size = 2
+		}
+		if size != 1 && size != 2 && size != 4 {
+			return nil, fmt.Errorf("invalid length prefix size: %d", size)
+		}
+		var order binary.ByteOrder = binary.LittleEndian
+		if settings.LengthBigEndian {
+			order = binary.BigEndian
+		}
+		return &lengthFramer{size: size, order: order, maxFrame: maxFrame}, nil
+	case prot.FramingNewline:
+		return &newlineFramer{maxFrame: maxFrame}, nil
+	case prot.FramingSLIP:
+		return &slipFramer{maxFrame: maxFrame}, nil
+	case prot.FramingCOBS:
+		return &cobsFramer{maxFrame: maxFrame}, nil
+	}
+	return nil, fmt.Errorf("unknown framing: %s", settings.Framing)
+}
+
+// lengthFramer reads frames preceded by their length.
+type lengthFramer struct {
+	size     int
+	order    binary.ByteOrder
+	maxFrame int
+	buf      []byte
+}
+
+func (f *lengthFramer) length(b []byte) int {
+	switch f.size {
+	case 1:
+		return int(b[0])
+	case 2:
+		return int(f.order.Uint16(b))
+	}
+	return int(f.order.Uint32(b))
+}
+
+func (f *lengthFramer) feed(b []byte) [][]byte {
+	f.buf = append(f.buf, b...)
+	var frames [][]byte
+	for len(f.buf) >= f.size {
+		n := f.length(f.buf)
+		if n > f.maxFrame {
+			// the stream is out of sync, nothing after this can be trusted
+			f.buf = nil
+			break
+		}
+		if len(f.buf) < f.size+n {
+			break
+		}
+		frames = append(frames, append([]byte(nil), f.buf[f.size:f.size+n]...))
+		f.buf = f.buf[f.size+n:]
+	}
+	return frames
+}
+
+func (f *lengthFramer) encode(frame []byte) []byte {
+	b := make([]byte, f.size, f.size+len(frame))
+	switch f.size {
+	case 1:
+		b[0] = byte(len(frame))
+	case 2:
+		f.order.PutUint16(b, uint16(len(frame)))
+	default:
+		f.order.PutUint32(b, uint32(len(frame)))
+	}
+	return append(b, frame...)
+}
+
+// delimitedFeed collects bytes up to the delimiter. Empty frames are skipped
+// and frames exceeding maxFrame are dropped up to the next delimiter.
+func delimitedFeed(buf *[]byte, overflow *bool, maxFrame int, delim byte, b []byte) [][]byte {
+	var frames [][]byte
+	for len(b) > 0 {
+		i := bytes.IndexByte(b, delim)
+		if i < 0 {
+			if !*overflow {
+				*buf = append(*buf, b...)
+			}
+			if len(*buf) > maxFrame {
+				*buf, *overflow = nil, true
+			}
+			break
+		}
+		if !*overflow {
+			*buf = append(*buf, b[:i]...)
+			if len(*buf) > 0 && len(*buf) <= maxFrame {
+				frames = append(frames, *buf)
+			}
+		}
+		*buf, *overflow = nil, false
+		b = b[i+1:]
+	}
+	return frames
+}
+
+// newlineFramer reads lines, a trailing carriage return is dropped.
+type newlineFramer struct {
+	maxFrame int
+	buf      []byte
+	overflow bool
+}
+
+func (f *newlineFramer) feed(b []byte) [][]byte {
+	frames := delimitedFeed(&f.buf, &f.overflow, f.maxFrame, '\n', b)
+	for i, frame := range frames {
+		frames[i] = bytes.TrimSuffix(frame, []byte{'\r'})
+	}
+	return frames
+}
+
+func (f *newlineFramer) encode(frame []byte) []byte {
+	return append(append([]byte(nil), frame...), '\n')
+}
+
+// SLIP special characters, RFC 1055.
+const (
+	slipEnd    = 0xC0
+	slipEsc    = 0xDB
+	slipEscEnd = 0xDC
+	slipEscEsc = 0xDD
+)
+
+type slipFramer struct {
+	maxFrame int
+	buf      []byte
+	overflow bool
+}
+
+func (f *slipFramer) feed(b []byte) [][]byte {
+	frames := delimitedFeed(&f.buf, &f.overflow, f.maxFrame, slipEnd, b)
+	for i, frame := range frames {
+		frames[i] = slipDecode(frame)
+	}
+	return frames
+}
+
+func slipDecode(frame []byte) []byte {
+	res := make([]byte, 0, len(frame))
+	for i := 0; i < len(frame); i++ {
+		c := frame[i]
+		if c == slipEsc && i+1 < len(frame) {
+			i++
+			switch frame[i] {
+			case slipEscEnd:
+				c = slipEnd
+			case slipEscEsc:
+				c = slipEsc
+			default:
+				c = frame[i]
+			}
+		}
+		res = append(res, c)
+	}
+	return res
+}
+
+func (f *slipFramer) encode(frame []byte) []byte {
+	res := make([]byte, 0, len(frame)+2)
+	res = append(res, slipEnd)
+	for _, c := range frame {
+		switch c {
+		case slipEnd:
+			res = append(res, slipEsc, slipEscEnd)
+		case slipEsc:
+			res = append(res, slipEsc, slipEscEsc)
+		default:
+			res = append(res, c)
+		}
+	}
+	return append(res, slipEnd)
+}
+
+// cobsFramer reads zero delimited frames with Consistent Overhead Byte
+// Stuffing.
+type cobsFramer struct {
+	maxFrame int
+	buf      []byte
+	overflow bool
+}
+
+func (f *cobsFramer) feed(b []byte) [][]byte {
+	var frames [][]byte
+	for _, frame := range delimitedFeed(&f.buf, &f.overflow, f.maxFrame, 0x00, b) {
+		decoded, ok := cobsDecode(frame)
+		if ok {
+			frames = append(frames, decoded)
+		}
+	}
+	return frames
+}
+
+func cobsDecode(frame []byte) ([]byte, bool) {
+	res := make([]byte, 0, len(frame))
+	for i := 0; i < len(frame); {
+		code := int(frame[i])
+		if code == 0 || i+code > len(frame) {
+			return nil, false
+		}
+		res = append(res, frame[i+1:i+code]...)
+		i += code
+		if code < 0xFF && i < len(frame) {
+			res = append(res, 0x00)
+		}
+	}
+	return res, true
+}
+
+func (f *cobsFramer) encode(frame []byte) []byte {
+	res := make([]byte, 1, len(frame)+len(frame)/254+2)
+	codeAt, code := 0, byte(1)
+	for i, c := range frame {
+		if c != 0x00 {
+			res = append(res, c)
+			code++
+		}
+		// a full block only starts another when more bytes follow
+		if c == 0x00 || code == 0xFF && i < len(frame)-1 {
+			res[codeAt] = code
+			codeAt, code = len(res), 1
+			res = append(res, 0x00)
+		}
+	}
+	res[codeAt] = code
+	return append(res, 0x00)
+}
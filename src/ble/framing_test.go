@@ -0,0 +1,169 @@
+package ble
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+// unhex decodes hex written with spaces between the bytes.
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		t.Fatalf("invalid hex %q: %s", s, err)
+	}
+	return b
+}
+
+// span returns the bytes from first to last.
+func span(first, last int) []byte {
+	var b []byte
+	for c := first; c <= last; c++ {
+		b = append(b, byte(c))
+	}
+	return b
+}
+
+func concat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func TestCOBSDecode(t *testing.T) {
+	// the examples of the COBS paper as listed on Wikipedia, without the
+	// trailing delimiter
+	tests := []struct {
+		name    string
+		encoded []byte
+		decoded []byte
+	}{
+		{name: "zero", encoded: []byte{0x01, 0x01}, decoded: []byte{0x00}},
+		{name: "two zeros", encoded: []byte{0x01, 0x01, 0x01}, decoded: []byte{0x00, 0x00}},
+		{name: "surrounded", encoded: []byte{0x01, 0x02, 0x11, 0x01}, decoded: []byte{0x00, 0x11, 0x00}},
+		{name: "middle zero", encoded: []byte{0x03, 0x11, 0x22, 0x02, 0x33}, decoded: []byte{0x11, 0x22, 0x00, 0x33}},
+		{name: "no zero", encoded: []byte{0x05, 0x11, 0x22, 0x33, 0x44}, decoded: []byte{0x11, 0x22, 0x33, 0x44}},
+		{name: "trailing zeros", encoded: []byte{0x02, 0x11, 0x01, 0x01, 0x01}, decoded: []byte{0x11, 0x00, 0x00, 0x00}},
+		{name: "254 non-zero", encoded: concat([]byte{0xFF}, span(0x01, 0xFE)), decoded: span(0x01, 0xFE)},
+		{name: "leading zero", encoded: concat([]byte{0x01, 0xFF}, span(0x01, 0xFE)), decoded: span(0x00, 0xFE)},
+		{name: "255 non-zero", encoded: concat([]byte{0xFF}, span(0x01, 0xFE), []byte{0x02, 0xFF}), decoded: span(0x01, 0xFF)},
+		{
+			name:    "split block then zero",
+			encoded: concat([]byte{0xFF}, span(0x02, 0xFF), []byte{0x01, 0x01}),
+			decoded: concat(span(0x02, 0xFF), []byte{0x00}),
+		},
+		{
+			name:    "short block",
+			encoded: concat([]byte{0xFE}, span(0x03, 0xFF), []byte{0x02, 0x01}),
+			decoded: concat(span(0x03, 0xFF), []byte{0x00, 0x01}),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := cobsDecode(tt.encoded)
+			if !ok || !bytes.Equal(got, tt.decoded) {
+				t.Errorf("cobsDecode(% x) = % x, %t, want % x", tt.encoded, got, ok, tt.decoded)
+			}
+			f := &cobsFramer{maxFrame: defaultMaxFrame}
+			if enc := f.encode(tt.decoded); !bytes.Equal(enc, append(tt.encoded, 0x00)) {
+				t.Errorf("encode(% x) = % x, want % x 00", tt.decoded, enc, tt.encoded)
+			}
+		})
+	}
+
+	for _, invalid := range [][]byte{{0x05, 0x11, 0x22}, {0x02, 0x11, 0x00, 0x01}} {
+		if got, ok := cobsDecode(invalid); ok {
+			t.Errorf("cobsDecode(% x) = % x, want it rejected", invalid, got)
+		}
+	}
+}
+
+func TestSLIPDecode(t *testing.T) {
+	// RFC 1055: END is C0, ESC is DB, escaped as DB DC and DB DD
+	tests := []struct {
+		name    string
+		encoded string
+		decoded string
+	}{
+		{name: "plain", encoded: "01 02 03", decoded: "01 02 03"},
+		{name: "escaped end", encoded: "01 db dc 02", decoded: "01 c0 02"},
+		{name: "escaped esc", encoded: "db dd", decoded: "db"},
+		{name: "both", encoded: "db dc db dd", decoded: "c0 db"},
+		// protocol violation, the byte is kept as RFC 1055 recommends
+		{name: "invalid escape", encoded: "db 01", decoded: "01"},
+		{name: "trailing esc", encoded: "01 db", decoded: "01 db"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, decoded := unhex(t, tt.encoded), unhex(t, tt.decoded)
+			if got := slipDecode(encoded); !bytes.Equal(got, decoded) {
+				t.Errorf("slipDecode(% x) = % x, want % x", encoded, got, decoded)
+			}
+		})
+	}
+
+	f := &slipFramer{maxFrame: defaultMaxFrame}
+	var frames [][]byte
+	for _, chunk := range []string{"c0 01 db", "dc 02 c0 c0", "03 c0"} {
+		frames = append(frames, f.feed(unhex(t, chunk))...)
+	}
+	if len(frames) != 2 || !bytes.Equal(frames[0], unhex(t, "01 c0 02")) || !bytes.Equal(frames[1], unhex(t, "03")) {
+		t.Errorf("frames % x, want [01 c0 02] [03]", frames)
+	}
+}
+
+func TestLengthFramerFeed(t *testing.T) {
+	tests := []struct {
+		name   string
+		framer *lengthFramer
+		chunks []string
+		want   []string
+	}{
+		{
+			name:   "2 byte little endian",
+			framer: &lengthFramer{size: 2, order: binary.LittleEndian, maxFrame: defaultMaxFrame},
+			chunks: []string{"03 00 61 62 63 02 00 64 65"},
+			want:   []string{"61 62 63", "64 65"},
+		},
+		{
+			name:   "2 byte big endian split",
+			framer: &lengthFramer{size: 2, order: binary.BigEndian, maxFrame: defaultMaxFrame},
+			chunks: []string{"00", "03 61", "62 63 00", "01 64"},
+			want:   []string{"61 62 63", "64"},
+		},
+		{
+			name:   "1 byte",
+			framer: &lengthFramer{size: 1, order: binary.LittleEndian, maxFrame: defaultMaxFrame},
+			chunks: []string{"01 ff 00 02 0a 0b"},
+			want:   []string{"ff", "", "0a 0b"},
+		},
+		{
+			name:   "4 byte incomplete",
+			framer: &lengthFramer{size: 4, order: binary.BigEndian, maxFrame: defaultMaxFrame},
+			chunks: []string{"00 00 00 02 61 62 00 00 00 05 61"},
+			want:   []string{"61 62"},
+		},
+		{
+			name:   "over the max frame",
+			framer: &lengthFramer{size: 1, order: binary.LittleEndian, maxFrame: 2},
+			chunks: []string{"03 61 62 63 01 64"},
+			want:   nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got [][]byte
+			for _, chunk := range tt.chunks {
+				got = append(got, tt.framer.feed(unhex(t, chunk))...)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("frames % x, want %v", got, tt.want)
+			}
+			for i, want := range tt.want {
+				if !bytes.Equal(got[i], unhex(t, want)) {
+					t.Errorf("frame %d % x, want %s", i, got[i], want)
+				}
+			}
+		})
+	}
+}
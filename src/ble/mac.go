@@ -0,0 +1,126 @@
+package ble
+
+import (
+	"clients/prot"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+)
+
+const (
+	macHMACSHA256 = "hmac-sha256"
+	macCMACAES128 = "cmac-aes128"
+
+	defaultMacTagLength = 4
+)
+
+// Outcomes of the MAC verification, recorded in the payload mac section.
+const (
+	macOK       = "ok"
+	macFailed   = "failed"
+	macNoKey    = "no key"
+	macTooShort = "too short"
+)
+
+// verifyMac checks the tag appended by the device to an authenticated
+// characteristic value. It returns the value without the tag and the outcome.
+func verifyMac(settings prot.MacSettings, keyHex string, value []byte) ([]byte, string, error) {
+	if keyHex == "" {
+		return value, macNoKey, nil
+	}
+	key, err := hex.DecodeString(keyHex)
+	if err != nil {
+		return value, macNoKey, fmt.Errorf("invalid mac key, err: %s", err)
+	}
+	tagLen := settings.TagLength
+	if tagLen <= 0 {
+		tagLen = defaultMacTagLength
+	}
+	if len(value) < tagLen {
+		return value, macTooShort, nil
+	}
+	data, tag := value[:len(value)-tagLen], value[len(value)-tagLen:]
+
+	var sum []byte
+	switch settings.Algorithm {
+	case "", macHMACSHA256:
+		h := hmac.New(sha256.New, key)
+		h.Write(data)
+		sum = h.Sum(nil)
+	case macCMACAES128:
+		sum, err = cmac(key, data)
+		if err != nil {
+			return value, macFailed, err
+		}
+	default:
+		return value, macFailed, fmt.Errorf("unknown mac algorithm: %s", settings.Algorithm)
+	}
+	if tagLen > len(sum) {
+		return value, macFailed, fmt.Errorf("mac tag length %d exceeds %s size", tagLen, settings.Algorithm)
+	}
+	if subtle.ConstantTimeCompare(sum[:tagLen], tag) != 1 {
+		return value, macFailed, nil
+	}
+	return data, macOK, nil
+}
+
+// cmac computes AES-CMAC as defined by RFC 4493.
+func cmac(key, msg []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	const bs = aes.BlockSize
+
+	// subkeys
+	k1 := make([]byte, bs)
+	block.Encrypt(k1, k1)
+	k1 = cmacShift(k1)
+	k2 := cmacShift(k1)
+
+	n := (len(msg) + bs - 1) / bs
+	last := make([]byte, bs)
+	if n > 0 && len(msg)%bs == 0 {
+		copy(last, msg[(n-1)*bs:])
+		xorBlock(last, k1)
+	} else {
+		if n == 0 {
+			n = 1
+		}
+		rest := msg[(n-1)*bs:]
+		copy(last, rest)
+		last[len(rest)] = 0x80
+		xorBlock(last, k2)
+	}
+
+	x := make([]byte, bs)
+	for i := 0; i < n-1; i++ {
+		xorBlock(x, msg[i*bs:(i+1)*bs])
+		block.Encrypt(x, x)
+	}
+	xorBlock(x, last)
+	block.Encrypt(x, x)
+	return x, nil
+}
+
+func cmacShift(b []byte) []byte {
+	res := make([]byte, len(b))
+	var carry byte
+	for i := len(b) - 1; i >= 0; i-- {
+		res[i] = b[i]<<1 | carry
+		carry = b[i] >> 7
+	}
+	if carry != 0 {
+		res[len(res)-1] ^= 0x87
+	}
+	return res
+}
+
+func xorBlock(dst, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
@@ -0,0 +1,94 @@
+package ble
+
+import (
+	"bytes"
+	"clients/prot"
+	"crypto/aes"
+	"db"
+	"encoding/binary"
+	"encoding/hex"
+	"strings"
+
+	"github.com/mihalicyn/gatt"
+)
+
+// matchAdvertisement tells whether the advertisement sent from the address
+// comes from the device, using the matching strategy of its group.
+func matchAdvertisement(device db.Device, settings prot.MatchSettings, address string, adv *gatt.Advertisement) bool {
+	switch settings.Strategy {
+	case "", prot.MatchMAC:
+		return strings.EqualFold(address, device.Hash)
+	case prot.MatchIRK:
+		if strings.EqualFold(address, device.Hash) {
+			// the identity address, when the device advertises with it
+			return true
+		}
+		return resolvePrivateAddress(device.IRK, address)
+	case prot.MatchManufacturerData:
+		d := adv.ManufacturerData
+		if len(d) < 2 {
+			return false
+		}
+		if settings.CompanyID != 0 && int(binary.LittleEndian.Uint16(d[0:2])) != settings.CompanyID {
+			return false
+		}
+		return matchIDField(d[2:], settings, device.Hash)
+	case prot.MatchServiceData:
+		for _, sd := range adv.ServiceData {
+			if matchesUUID(sd.UUID, settings.Service) && matchIDField(sd.Data, settings, device.Hash) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchIDField(d []byte, settings prot.MatchSettings, hash string) bool {
+	if settings.Offset < 0 || settings.Offset >= len(d) {
+		return false
+	}
+	d = d[settings.Offset:]
+	if settings.Length > 0 {
+		if settings.Length > len(d) {
+			return false
+		}
+		d = d[:settings.Length]
+	}
+	return strings.EqualFold(hex.EncodeToString(d), hash)
+}
+
+// resolvePrivateAddress tells whether the address is a resolvable private
+// address generated with the IRK, given as hex with the most significant
+// byte first.
+func resolvePrivateAddress(irkHex, address string) bool {
+	if irkHex == "" {
+		return false
+	}
+	irk, err := hex.DecodeString(irkHex)
+	if err != nil || len(irk) != 16 {
+		return false
+	}
+	addr, err := hex.DecodeString(strings.Replace(address, ":", "", -1))
+	if err != nil || len(addr) != 6 {
+		return false
+	}
+	// the two most significant bits of a resolvable address are 0b01
+	if addr[0]>>6 != 0x01 {
+		return false
+	}
+	prand, hash := addr[0:3], addr[3:6]
+	return bytes.Equal(rpaHash(irk, prand), hash)
+}
+
+// rpaHash is the random address hash function ah of the Bluetooth Core
+// specification, Vol 3, Part H, 2.2.2.
+func rpaHash(irk, prand []byte) []byte {
+	block, err := aes.NewCipher(irk)
+	if err != nil {
+		return nil
+	}
+	b := make([]byte, aes.BlockSize)
+	copy(b[aes.BlockSize-3:], prand)
+	block.Encrypt(b, b)
+	return b[aes.BlockSize-3:]
+}
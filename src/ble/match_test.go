@@ -0,0 +1,61 @@
+package ble
+
+import (
+	"bytes"
+	"testing"
+)
+
+// the sample data of the Bluetooth Core specification, Vol 3, Part H, D.7
+const (
+	testIRK   = "ec0234a357c8ad05341010a60a397d9b"
+	testPrand = "70 81 94"
+	testAH    = "0d fb aa"
+)
+
+func TestRPAHash(t *testing.T) {
+	tests := []struct {
+		name  string
+		irk   string
+		prand string
+		// whether ah is the sample hash
+		want bool
+	}{
+		{name: "core specification", irk: testIRK, prand: testPrand, want: true},
+		{name: "other prand", irk: testIRK, prand: "70 81 95"},
+		{name: "other irk", irk: "ec0234a357c8ad05341010a60a397d9c", prand: testPrand},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ah := rpaHash(unhex(t, tt.irk), unhex(t, tt.prand))
+			if bytes.Equal(ah, unhex(t, testAH)) != tt.want {
+				t.Errorf("ah %x, sample %s, want a match %t", ah, testAH, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolvePrivateAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		irk     string
+		address string
+		want    bool
+	}{
+		{name: "resolvable", irk: testIRK, address: "70:81:94:0d:fb:aa", want: true},
+		{name: "upper case", irk: testIRK, address: "70:81:94:0D:FB:AA", want: true},
+		{name: "other hash", irk: testIRK, address: "70:81:94:0d:fb:ab"},
+		{name: "other irk", irk: "ec0234a357c8ad05341010a60a397d9c", address: "70:81:94:0d:fb:aa"},
+		// the same bytes with the top bits of a static address
+		{name: "not resolvable", irk: testIRK, address: "f0:81:94:0d:fb:aa"},
+		{name: "no irk", address: "70:81:94:0d:fb:aa"},
+		{name: "short irk", irk: "ec0234a357c8ad05", address: "70:81:94:0d:fb:aa"},
+		{name: "invalid address", irk: testIRK, address: "70:81:94"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolvePrivateAddress(tt.irk, tt.address); got != tt.want {
+				t.Errorf("resolved %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
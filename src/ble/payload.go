@@ -0,0 +1,71 @@
+package ble
+
+import (
+	"encoding/json"
+	"sync"
+
+	"github.com/mihalicyn/gatt"
+)
+
+// Sections of the payload that don't hold characteristic values. Keys of
+// the diagnostics, mac and timestamps sections are "<service>/<characteristic>",
+// the procedure section is keyed by step, the time sync and uart sections by
+// field. Timestamps are the unix milliseconds each value was read or notified.
+const (
+	diagnosticsSection = "_diagnostics"
+	macSection         = "_mac"
+	procedureSection   = "_procedure"
+	timeSyncSection    = "_time_sync"
+	uartSection        = "_uart"
+	timestampsSection  = "_timestamps"
+)
+
+// payload collects the values read during a session. Notifications arrive
+// on another goroutine, so every access is guarded.
+type payload struct {
+	mu     sync.Mutex
+	values map[string]map[string]string
+}
+
+func newPayload() *payload {
+	return &payload{values: make(map[string]map[string]string)}
+}
+
+func (p *payload) set(section, key, value string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// init map if is not yet allocated
+	_, ok := p.values[section]
+	if !ok {
+		p.values[section] = make(map[string]string)
+	}
+	p.values[section][key] = value
+}
+
+// diagnose records a problem with a characteristic of the device group.
+func (p *payload) diagnose(service, char, msg string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := service + "/" + char
+	_, ok := p.values[diagnosticsSection]
+	if !ok {
+		p.values[diagnosticsSection] = make(map[string]string)
+	}
+	if prev, ok := p.values[diagnosticsSection][key]; ok {
+		msg = prev + "; " + msg
+	}
+	p.values[diagnosticsSection][key] = msg
+}
+
+func (p *payload) marshal() ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return json.Marshal(p.values)
+}
+
+// matchesUUID compares an attribute UUID to a name from the device group
+// definition, which may be written with dashes or as the 128-bit form of a
+// 16-bit SIG UUID.
+func matchesUUID(u gatt.UUID, name string) bool {
+	return normalizeUUID(u.String()) == normalizeUUID(name)
+}
@@ -0,0 +1,98 @@
+package ble
+
+import (
+	"db"
+	"sync"
+	"time"
+)
+
+// rssiSmoothing is the weight of a new RSSI sample in the moving average.
+const rssiSmoothing = 0.2
+
+// presence keeps track of when whitelisted devices were heard and how well.
+type presence struct {
+	mu      sync.Mutex
+	window  time.Duration
+	entries map[string]*db.Presence
+}
+
+func newPresence(database *db.DBAdapter, window time.Duration) (*presence, error) {
+	presences, err := database.GetPresences()
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]*db.Presence, len(presences))
+	for i := range presences {
+		entries[presences[i].DeviceHash] = &presences[i]
+	}
+	return &presence{
+		window:  window,
+		entries: entries,
+	}, nil
+}
+
+func (p *presence) entry(hash string) *db.Presence {
+	e, ok := p.entries[hash]
+	if !ok {
+		e = &db.Presence{DeviceHash: hash}
+		p.entries[hash] = e
+	}
+	return e
+}
+
+// rollWindow closes the advertisement counting window if it's over.
+func (p *presence) rollWindow(e *db.Presence, now int) {
+	window := int(p.window / time.Second)
+	if now-e.WindowStart < window {
+		return
+	}
+	if now-e.WindowStart < 2*window {
+		e.AdvCount = e.WindowCount
+	} else {
+		// nothing heard during the last full window
+		e.AdvCount = 0
+	}
+	e.WindowStart = now - (now-e.WindowStart)%window
+	e.WindowCount = 0
+}
+
+// seen records an advertisement of the device.
+func (p *presence) seen(hash string, rssi int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := int(time.Now().Unix())
+	e := p.entry(hash)
+	if e.WindowStart == 0 {
+		e.WindowStart = now
+	}
+	p.rollWindow(e, now)
+	e.WindowCount++
+	if e.LastSeen == 0 {
+		e.RSSI = float64(rssi)
+	} else {
+		e.RSSI += rssiSmoothing * (float64(rssi) - e.RSSI)
+	}
+	e.LastSeen = now
+}
+
+// sessionSucceeded records a successful session with the device.
+func (p *presence) sessionSucceeded(hash string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.entry(hash).LastSession = int(time.Now().Unix())
+}
+
+// snapshot returns a copy of the current presence table.
+func (p *presence) snapshot() []db.Presence {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := int(time.Now().Unix())
+	res := make([]db.Presence, 0, len(p.entries))
+	for _, e := range p.entries {
+		if e.WindowStart != 0 {
+			p.rollWindow(e, now)
+		}
+		res = append(res, *e)
+	}
+	return res
+}
@@ -0,0 +1,210 @@
+package ble
+
+import (
+	"bytes"
+	"clients/prot"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mihalicyn/gatt"
+)
+
+// defaultNotificationTimeout bounds wait_notification steps without duration.
+const defaultNotificationTimeout = 5 * time.Second
+
+// procedure executes the scripted steps of a device group during a session.
+type procedure struct {
+	p             gatt.Peripheral
+	services      []*gatt.Service
+	payload       *payload
+	results       map[string][]byte
+	notifications map[*gatt.Characteristic]chan []byte
+}
+
+// runProcedure executes the steps, recording each step result in the
+// payload procedure section. It stops at the first failed step.
+func runProcedure(p gatt.Peripheral, services []*gatt.Service, steps []prot.ProcedureStep, payload *payload) error {
+	proc := &procedure{
+		p:             p,
+		services:      services,
+		payload:       payload,
+		results:       make(map[string][]byte),
+		notifications: make(map[*gatt.Characteristic]chan []byte),
+	}
+	// Notifications may be triggered by an earlier step, so subscribe
+	// before anything is written.
+	err := proc.subscribe(steps)
+	if err != nil {
+		return err
+	}
+	return proc.run(steps, "")
+}
+
+// lookupCharacteristic finds the characteristic by the UUIDs used in device
+// group definitions.
+func lookupCharacteristic(services []*gatt.Service, service, char string) *gatt.Characteristic {
+	for _, s := range services {
+		if !matchesUUID(s.UUID(), service) {
+			continue
+		}
+		for _, c := range s.Characteristics() {
+			if matchesUUID(c.UUID(), char) {
+				return c
+			}
+		}
+	}
+	return nil
+}
+
+func (proc *procedure) characteristic(step prot.ProcedureStep) (*gatt.Characteristic, error) {
+	c := lookupCharacteristic(proc.services, step.Service, step.Characteristic)
+	if c == nil {
+		return nil, fmt.Errorf("characteristic %s/%s not found on device", step.Service, step.Characteristic)
+	}
+	return c, nil
+}
+
+func (proc *procedure) subscribe(steps []prot.ProcedureStep) error {
+	for _, step := range steps {
+		if step.Op == prot.OpBranch {
+			err := proc.subscribe(step.Then)
+			if err == nil {
+				err = proc.subscribe(step.Else)
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if step.Op != prot.OpWaitNotification {
+			continue
+		}
+		c, err := proc.characteristic(step)
+		if err != nil {
+			return err
+		}
+		if _, ok := proc.notifications[c]; ok {
+			continue
+		}
+		ch := make(chan []byte, 16)
+		f := func(c *gatt.Characteristic, b []byte, err error) {
+			select {
+			case ch <- b:
+			default:
+			}
+		}
+		if (c.Properties()&gatt.CharIndicate) != 0 && (c.Properties()&gatt.CharNotify) == 0 {
+			err = proc.p.SetIndicateValue(c, f)
+		} else {
+			err = proc.p.SetNotifyValue(c, f)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to subscribe %s/%s, err: %s", step.Service, step.Characteristic, err)
+		}
+		proc.notifications[c] = ch
+	}
+	return nil
+}
+
+func (proc *procedure) run(steps []prot.ProcedureStep, prefix string) error {
+	for i, step := range steps {
+		key := prefix + strconv.Itoa(i+1) + "." + step.Op
+		if step.Name != "" {
+			key = step.Name
+		}
+		result, err := proc.step(step, prefix+strconv.Itoa(i+1)+".")
+		if err != nil {
+			proc.payload.set(procedureSection, key, "error: "+err.Error())
+			return fmt.Errorf("procedure step %s failed, err: %s", key, err)
+		}
+		proc.payload.set(procedureSection, key, result)
+	}
+	return nil
+}
+
+func (proc *procedure) step(step prot.ProcedureStep, prefix string) (string, error) {
+	switch step.Op {
+	case prot.OpWrite, prot.OpWriteWithoutResponse:
+		c, err := proc.characteristic(step)
+		if err != nil {
+			return "", err
+		}
+		b, err := hex.DecodeString(step.Value)
+		if err != nil {
+			return "", err
+		}
+		err = proc.p.WriteCharacteristic(c, b, step.Op == prot.OpWriteWithoutResponse)
+		if err != nil {
+			return "", err
+		}
+		return "ok", nil
+	case prot.OpRead:
+		c, err := proc.characteristic(step)
+		if err != nil {
+			return "", err
+		}
+		b, err := proc.p.ReadLongCharacteristic(c)
+		if err != nil {
+			return "", err
+		}
+		proc.results[step.Name] = b
+		return hex.EncodeToString(b), nil
+	case prot.OpWaitNotification:
+		c, err := proc.characteristic(step)
+		if err != nil {
+			return "", err
+		}
+		timeout := defaultNotificationTimeout
+		if step.Duration > 0 {
+			timeout = time.Duration(step.Duration) * time.Millisecond
+		}
+		select {
+		case b := <-proc.notifications[c]:
+			proc.results[step.Name] = b
+			return hex.EncodeToString(b), nil
+		case <-time.After(timeout):
+			return "", fmt.Errorf("no notification within %s", timeout)
+		}
+	case prot.OpDelay:
+		time.Sleep(time.Duration(step.Duration) * time.Millisecond)
+		return "ok", nil
+	case prot.OpBranch:
+		ok, err := proc.test(step.If)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			return "then", proc.run(step.Then, prefix+"then.")
+		}
+		return "else", proc.run(step.Else, prefix+"else.")
+	}
+	return "", fmt.Errorf("unknown operation: %s", step.Op)
+}
+
+func (proc *procedure) test(cond *prot.ProcedureCondition) (bool, error) {
+	if cond == nil {
+		return false, fmt.Errorf("branch without condition")
+	}
+	value, ok := proc.results[cond.Step]
+	if !ok {
+		return false, fmt.Errorf("no result of step %s", cond.Step)
+	}
+	expected := func(s string) ([]byte, error) {
+		return hex.DecodeString(strings.Replace(s, " ", "", -1))
+	}
+	switch {
+	case cond.Equals != "":
+		b, err := expected(cond.Equals)
+		return bytes.Equal(value, b), err
+	case cond.NotEquals != "":
+		b, err := expected(cond.NotEquals)
+		return !bytes.Equal(value, b), err
+	case cond.Prefix != "":
+		b, err := expected(cond.Prefix)
+		return bytes.HasPrefix(value, b), err
+	}
+	return false, fmt.Errorf("empty condition on step %s", cond.Step)
+}
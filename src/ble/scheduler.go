@@ -0,0 +1,102 @@
+package ble
+
+import (
+	"clients/prot"
+	"db"
+	"sync"
+	"time"
+)
+
+// scheduler decides when a device may be connected to again. Cooldowns
+// depend on the outcome of the last session and grow exponentially while
+// sessions keep failing. The state is persisted so that a restart doesn't
+// reconnect to every device at once.
+type scheduler struct {
+	mu           sync.Mutex
+	db           *db.DBAdapter
+	successDelay time.Duration
+	failureDelay time.Duration
+	maxBackoff   time.Duration
+	entries      map[string]*db.Schedule
+}
+
+func newScheduler(database *db.DBAdapter, successDelay, failureDelay, maxBackoff time.Duration) (*scheduler, error) {
+	schedules, err := database.GetSchedules()
+	if err != nil {
+		return nil, err
+	}
+	entries := make(map[string]*db.Schedule, len(schedules))
+	for i := range schedules {
+		entries[schedules[i].DeviceHash] = &schedules[i]
+	}
+	return &scheduler{
+		db:           database,
+		successDelay: successDelay,
+		failureDelay: failureDelay,
+		maxBackoff:   maxBackoff,
+		entries:      entries,
+	}, nil
+}
+
+// ready reports whether the device cooldown is over.
+func (s *scheduler) ready(hash string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[hash]
+	if !ok {
+		return true
+	}
+	return time.Now().Unix() >= int64(e.NextAttempt)
+}
+
+// succeeded resets the backoff and schedules the next regular session.
+func (s *scheduler) succeeded(hash string, settings prot.DeviceGroupSettings) error {
+	delay := s.successDelay
+	if settings.SuccessInterval > 0 {
+		delay = time.Duration(settings.SuccessInterval) * time.Second
+	}
+	return s.update(hash, 0, delay)
+}
+
+// failed schedules a retry, doubling the delay on each consecutive failure.
+func (s *scheduler) failed(hash string, settings prot.DeviceGroupSettings) error {
+	delay := s.failureDelay
+	if settings.FailureInterval > 0 {
+		delay = time.Duration(settings.FailureInterval) * time.Second
+	}
+	maxBackoff := s.maxBackoff
+	if settings.MaxBackoff > 0 {
+		maxBackoff = time.Duration(settings.MaxBackoff) * time.Second
+	}
+
+	s.mu.Lock()
+	failures := 1
+	if e, ok := s.entries[hash]; ok {
+		failures = e.Failures + 1
+	}
+	s.mu.Unlock()
+
+	for i := 1; i < failures && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	return s.update(hash, failures, delay)
+}
+
+func (s *scheduler) update(hash string, failures int, delay time.Duration) error {
+	now := time.Now()
+	e := db.Schedule{
+		DeviceHash:  hash,
+		NextAttempt: int(now.Add(delay).Unix()),
+		Failures:    failures,
+		UpdatedAt:   int(now.Unix()),
+	}
+
+	s.mu.Lock()
+	s.entries[hash] = &e
+	s.mu.Unlock()
+
+	return s.db.UpsertSchedule(e)
+}
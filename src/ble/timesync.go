@@ -0,0 +1,149 @@
+package ble
+
+import (
+	"clients/prot"
+	"db"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/mihalicyn/gatt"
+)
+
+var (
+	attrCurrentTimeServiceUUID = gatt.UUID16(0x1805)
+	attrCurrentTimeUUID        = gatt.UUID16(0x2A2B)
+)
+
+// encodeCurrentTime encodes the Current Time characteristic: exact time 256
+// followed by the adjust reason.
+func encodeCurrentTime(t time.Time) []byte {
+	b := make([]byte, 10)
+	binary.LittleEndian.PutUint16(b[0:2], uint16(t.Year()))
+	b[2] = byte(t.Month())
+	b[3] = byte(t.Day())
+	b[4] = byte(t.Hour())
+	b[5] = byte(t.Minute())
+	b[6] = byte(t.Second())
+	// Monday is 1, Sunday is 7
+	b[7] = byte((int(t.Weekday())+6)%7 + 1)
+	b[8] = byte(t.Nanosecond() * 256 / int(time.Second))
+	// manual time update
+	b[9] = 0x01
+	return b
+}
+
+func decodeCurrentTime(b []byte) (time.Time, error) {
+	if len(b) < 7 {
+		return time.Time{}, fmt.Errorf("current time too short: %d bytes", len(b))
+	}
+	year := int(binary.LittleEndian.Uint16(b[0:2]))
+	fractions := 0
+	if len(b) >= 9 {
+		fractions = int(b[8])
+	}
+	return time.Date(year, time.Month(b[2]), int(b[3]), int(b[4]), int(b[5]), int(b[6]),
+		fractions*int(time.Second)/256, time.Local), nil
+}
+
+func encodeTime(format string, t time.Time) ([]byte, error) {
+	switch format {
+	case prot.TimeFormatCurrentTime:
+		return encodeCurrentTime(t), nil
+	case "", prot.TimeFormatUnix32LE:
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, uint32(t.Unix()))
+		return b, nil
+	case prot.TimeFormatUnix32BE:
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(t.Unix()))
+		return b, nil
+	case prot.TimeFormatUnixMs64LE:
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, uint64(t.UnixNano()/int64(time.Millisecond)))
+		return b, nil
+	}
+	return nil, fmt.Errorf("unknown time format: %s", format)
+}
+
+func decodeTime(format string, b []byte) (time.Time, error) {
+	switch format {
+	case prot.TimeFormatCurrentTime:
+		return decodeCurrentTime(b)
+	case "", prot.TimeFormatUnix32LE:
+		if len(b) < 4 {
+			break
+		}
+		return time.Unix(int64(binary.LittleEndian.Uint32(b)), 0), nil
+	case prot.TimeFormatUnix32BE:
+		if len(b) < 4 {
+			break
+		}
+		return time.Unix(int64(binary.BigEndian.Uint32(b)), 0), nil
+	case prot.TimeFormatUnixMs64LE:
+		if len(b) < 8 {
+			break
+		}
+		ms := int64(binary.LittleEndian.Uint64(b))
+		return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond)), nil
+	default:
+		return time.Time{}, fmt.Errorf("unknown time format: %s", format)
+	}
+	return time.Time{}, fmt.Errorf("time value too short: %d bytes", len(b))
+}
+
+// syncTime writes the gateway time to the device. The device clock drift
+// measured before the write is recorded in the payload time sync section.
+func syncTime(p gatt.Peripheral, services []*gatt.Service, settings prot.TimeSyncSettings, payload *payload) error {
+	var c *gatt.Characteristic
+	format := settings.Format
+	if settings.Characteristic != "" {
+		c = lookupCharacteristic(services, settings.Service, settings.Characteristic)
+	} else {
+		c = findCharacteristic(services, attrCurrentTimeServiceUUID, attrCurrentTimeUUID)
+		format = prot.TimeFormatCurrentTime
+	}
+	if c == nil {
+		payload.set(timeSyncSection, "status", "no time characteristic")
+		return nil
+	}
+	payload.set(timeSyncSection, "characteristic", c.UUID().String())
+
+	if db.Timestamp(time.Now()) < db.MinValidTimestamp {
+		// better a drifting device clock than a wrong one
+		payload.set(timeSyncSection, "status", "gateway clock not set")
+		return nil
+	}
+
+	if (c.Properties() & gatt.CharRead) != 0 {
+		b, err := p.ReadCharacteristic(c)
+		if err != nil {
+			return fmt.Errorf("failed to read device time, err: %s", err)
+		}
+		now := time.Now()
+		deviceTime, err := decodeTime(format, b)
+		if err != nil {
+			payload.set(timeSyncSection, "drift_ms", "unknown")
+		} else {
+			drift := deviceTime.Sub(now) / time.Millisecond
+			payload.set(timeSyncSection, "drift_ms", strconv.FormatInt(int64(drift), 10))
+		}
+	} else {
+		payload.set(timeSyncSection, "drift_ms", "unknown")
+	}
+
+	now := time.Now()
+	b, err := encodeTime(format, now)
+	if err != nil {
+		return err
+	}
+	noRsp := (c.Properties()&gatt.CharWrite) == 0 && (c.Properties()&gatt.CharWriteNR) != 0
+	err = p.WriteCharacteristic(c, b, noRsp)
+	if err != nil {
+		return fmt.Errorf("failed to write device time, err: %s", err)
+	}
+	payload.set(timeSyncSection, "written", now.Format(time.RFC3339Nano))
+	payload.set(timeSyncSection, "status", "ok")
+	return nil
+}
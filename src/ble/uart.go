@@ -0,0 +1,121 @@
+package ble
+
+import (
+	"clients/prot"
+	"db"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/mihalicyn/gatt"
+)
+
+// Nordic UART Service. The device notifies on TX and receives on RX.
+const (
+	nusServiceUUID = "6E400001-B5A3-F393-E0A9-E50E24DCCA9E"
+	nusRXUUID      = "6E400002-B5A3-F393-E0A9-E50E24DCCA9E"
+	nusTXUUID      = "6E400003-B5A3-F393-E0A9-E50E24DCCA9E"
+)
+
+// uartChunkSize fits a write into the default ATT MTU, which is all a
+// device may support.
+const uartChunkSize = 20
+
+// runUART subscribes to the TX characteristic and writes the request frames
+// to RX. Frames keep arriving while the session lasts, each is sent as a
+// transaction keyed like a characteristic value of the TX characteristic.
+func (ble *MoecoBLE) runUART(p gatt.Peripheral, services []*gatt.Service, device db.Device,
+	settings prot.UARTSettings, payload *payload) error {
+	service, rx, tx := settings.Service, settings.RX, settings.TX
+	if service == "" {
+		service = nusServiceUUID
+	}
+	if rx == "" {
+		rx = nusRXUUID
+	}
+	if tx == "" {
+		tx = nusTXUUID
+	}
+
+	f, err := newFramer(settings)
+	if err != nil {
+		return err
+	}
+	txChar := lookupCharacteristic(services, service, tx)
+	if txChar == nil {
+		payload.diagnose(service, tx, "characteristic not found on device")
+		return fmt.Errorf("uart characteristic %s/%s not found on device", service, tx)
+	}
+
+	var mu sync.Mutex
+	frames := 0
+	notify := func(c *gatt.Characteristic, b []byte, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, frame := range f.feed(b) {
+			frames++
+			payload.set(uartSection, "frames", strconv.Itoa(frames))
+			ble.sendFrame(device, service, tx, frames, frame)
+		}
+	}
+	if (txChar.Properties()&gatt.CharIndicate) != 0 && (txChar.Properties()&gatt.CharNotify) == 0 {
+		err = p.SetIndicateValue(txChar, notify)
+	} else {
+		err = p.SetNotifyValue(txChar, notify)
+	}
+	if err != nil {
+		payload.diagnose(service, tx, "subscribe failed: "+err.Error())
+		return fmt.Errorf("failed to subscribe uart %s/%s, err: %s", service, tx, err)
+	}
+	payload.set(uartSection, "frames", "0")
+
+	if len(settings.Requests) == 0 {
+		return nil
+	}
+	rxChar := lookupCharacteristic(services, service, rx)
+	if rxChar == nil {
+		payload.diagnose(service, rx, "characteristic not found on device")
+		return fmt.Errorf("uart characteristic %s/%s not found on device", service, rx)
+	}
+	noRsp := (rxChar.Properties()&gatt.CharWrite) == 0 && (rxChar.Properties()&gatt.CharWriteNR) != 0
+	for i, request := range settings.Requests {
+		b, err := hex.DecodeString(request)
+		if err != nil {
+			return fmt.Errorf("invalid uart request %d, err: %s", i+1, err)
+		}
+		b = f.encode(b)
+		for len(b) > 0 {
+			n := uartChunkSize
+			if n > len(b) {
+				n = len(b)
+			}
+			err = p.WriteCharacteristic(rxChar, b[:n], noRsp)
+			if err != nil {
+				return fmt.Errorf("failed to write uart request %d, err: %s", i+1, err)
+			}
+			b = b[n:]
+		}
+	}
+	payload.set(uartSection, "requests", strconv.Itoa(len(settings.Requests)))
+	return nil
+}
+
+// sendFrame puts a transaction with a single UART frame on the channel.
+func (ble *MoecoBLE) sendFrame(device db.Device, service, char string, seq int, frame []byte) {
+	b, err := json.Marshal(map[string]map[string]string{
+		service:     {char: hex.EncodeToString(frame)},
+		uartSection: {"sequence": strconv.Itoa(seq)},
+	})
+	if err != nil {
+		*ble.errors <- err
+		return
+	}
+	*ble.transactions <- db.Transaction{
+		DeviceHash: device.Hash,
+		Timestamp:  db.Timestamp(time.Now()),
+		Payload:    string(b),
+	}
+}
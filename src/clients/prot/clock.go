@@ -0,0 +1,63 @@
+package prot
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// clockJump is the change of offset taken as a clock set on either side
+// rather than noise, the estimate starts over then.
+const clockJump = time.Minute
+
+// clock estimates the offset of the masternode clock from the local one,
+// out of the Date headers of the responses.
+type clock struct {
+	mu     sync.Mutex
+	offset time.Duration
+	known  bool
+}
+
+// observe takes a sample from a response received at end for a request
+// sent at start. The Date header has a resolution of a second, so the
+// server time is taken in the middle of that second, and the local time
+// in the middle of the round trip.
+func (c *clock) observe(date string, start, end time.Time) {
+	serverTime, err := http.ParseTime(date)
+	if err != nil {
+		return
+	}
+	serverTime = serverTime.Add(500 * time.Millisecond)
+	localTime := start.Add(end.Sub(start) / 2)
+	sample := serverTime.Sub(localTime)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	diff := sample - c.offset
+	if !c.known || diff > clockJump || diff < -clockJump {
+		c.offset = sample
+		c.known = true
+		return
+	}
+	// smooth out the second resolution of the header
+	c.offset += diff / 4
+}
+
+func (c *clock) get() (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.offset, c.known
+}
+
+// ClockOffset returns how far the masternode clock is ahead of the local
+// one, and false before any response with a Date header.
+func (c *Client) ClockOffset() (time.Duration, bool) {
+	return c.clock.get()
+}
+
+// ServerTime returns the current time of the masternode as estimated, the
+// local time before any response with a Date header.
+func (c *Client) ServerTime() time.Time {
+	offset, _ := c.clock.get()
+	return time.Now().Add(offset)
+}
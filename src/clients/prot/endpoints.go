@@ -0,0 +1,295 @@
+package prot
+
+import (
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Selections of the masternode endpoint requests go to.
+const (
+	// SelectPriority uses the first healthy endpoint in the order given,
+	// going back to a preferred one once it was healthy for the failback
+	// delay.
+	SelectPriority = "priority"
+	// SelectRoundRobin spreads requests over the healthy endpoints.
+	SelectRoundRobin = "round_robin"
+)
+
+const (
+	// defaultFailback is how long a preferred endpoint must stay healthy
+	// before requests go back to it.
+	defaultFailback = 5 * time.Minute
+	// Delays before a failed endpoint is probed again, doubling with every
+	// failure.
+	minRetryDelay = 5 * time.Second
+	maxRetryDelay = 5 * time.Minute
+)
+
+// StatusError is returned for responses without a 2xx status. Those with a
+// server error status count as failures of the endpoint.
+type StatusError struct {
+	Endpoint string
+	Code     int
+}
+
+func (e *StatusError) Error() string {
+	return e.Endpoint + " answered " + strconv.Itoa(e.Code)
+}
+
+func (e *StatusError) serverError() bool {
+	return e.Code >= 500
+}
+
+// EndpointHealth is the state of a masternode endpoint.
+type EndpointHealth struct {
+	URL          string    `json:"url"`
+	Current      bool      `json:"current"`
+	Healthy      bool      `json:"healthy"`
+	HealthySince time.Time `json:"healthy_since"`
+	Failures     int       `json:"failures"`
+	LastError    string    `json:"last_error"`
+}
+
+// endpoint is a masternode the gateway can talk to. Gateways authenticate
+// with each masternode separately, and each has its own sync cursor since
+// last_sync is a time of its clock.
+type endpoint struct {
+	url           string
+	healthy       bool
+	healthySince  time.Time
+	failures      int
+	lastError     string
+	retryAt       time.Time
+	authenticated bool
+	lastSync      int
+}
+
+// endpoints track the health of the masternodes and select the one for a
+// request.
+type endpoints struct {
+	mu        sync.Mutex
+	list      []*endpoint
+	selection string
+	failback  time.Duration
+	current   int
+}
+
+func newEndpoints(urls ...string) *endpoints {
+	e := &endpoints{selection: SelectPriority, failback: defaultFailback}
+	e.add(urls...)
+	return e
+}
+
+func (e *endpoints) add(urls ...string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	for _, u := range urls {
+		// healthy until proven otherwise, but not yet preferred over the
+		// current one
+		e.list = append(e.list, &endpoint{url: u, healthy: true, healthySince: now})
+	}
+}
+
+func (e *endpoints) all() []*endpoint {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]*endpoint(nil), e.list...)
+}
+
+// pick returns the endpoint for the next request, skipping those in except.
+// Unhealthy endpoints are only picked when no other is left.
+func (e *endpoints) pick(except map[*endpoint]bool) *endpoint {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	n := len(e.list)
+	if e.selection == SelectRoundRobin {
+		for i := 1; i <= n; i++ {
+			idx := (e.current + i) % n
+			if ep := e.list[idx]; ep.healthy && !except[ep] {
+				e.current = idx
+				return ep
+			}
+		}
+	} else {
+		cur := e.list[e.current]
+		curUsable := cur.healthy && !except[cur]
+		for idx, ep := range e.list {
+			if !ep.healthy || except[ep] {
+				continue
+			}
+			switch {
+			case idx == e.current:
+				return ep
+			case idx < e.current:
+				// a preferred endpoint takes over once it is stable
+				if !curUsable || now.Sub(ep.healthySince) >= e.failback {
+					e.current = idx
+					return ep
+				}
+			default:
+				// the current endpoint failed
+				e.current = idx
+				return ep
+			}
+		}
+	}
+	// none is healthy, try the one due for a retry first
+	var res *endpoint
+	for _, ep := range e.list {
+		if !except[ep] && (res == nil || ep.retryAt.Before(res.retryAt)) {
+			res = ep
+		}
+	}
+	return res
+}
+
+func (e *endpoints) succeeded(ep *endpoint) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if !ep.healthy {
+		ep.healthy = true
+		ep.healthySince = time.Now()
+	}
+	ep.failures = 0
+	ep.lastError = ""
+}
+
+func (e *endpoints) failed(ep *endpoint, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ep.healthy = false
+	ep.failures++
+	ep.lastError = err.Error()
+	delay := minRetryDelay
+	for i := 1; i < ep.failures && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay || IsPinError(err) {
+		delay = maxRetryDelay
+	}
+	ep.retryAt = time.Now().Add(delay)
+}
+
+// probes returns the endpoints to check: those not in use, once their
+// retry delay is over.
+func (e *endpoints) probes() []*endpoint {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := time.Now()
+	var res []*endpoint
+	for idx, ep := range e.list {
+		if idx == e.current && ep.healthy || now.Before(ep.retryAt) {
+			continue
+		}
+		res = append(res, ep)
+	}
+	return res
+}
+
+func (e *endpoints) setAuthenticated(ep *endpoint, authenticated bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ep.authenticated = authenticated
+}
+
+func (e *endpoints) isAuthenticated(ep *endpoint) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return ep.authenticated
+}
+
+func (e *endpoints) cursor(ep *endpoint) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return ep.lastSync
+}
+
+func (e *endpoints) setCursor(ep *endpoint, lastSync int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	ep.lastSync = lastSync
+}
+
+// unreached tells whether a request failed before reaching the masternode,
+// so it may be sent to another one without being handled twice.
+func unreached(err error) bool {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if _, ok := err.(*ProxyError); ok {
+		return true
+	}
+	opErr, ok := err.(*net.OpError)
+	return ok && opErr.Op == "dial"
+}
+
+// AddEndpoints adds masternodes to fail over to, in order of preference.
+func (c *Client) AddEndpoints(urls ...string) {
+	c.endpoints.add(urls...)
+}
+
+// SetSelection sets how the endpoint of a request is selected, and how long
+// a preferred endpoint must be healthy for requests to go back to it.
+func (c *Client) SetSelection(selection string, failback time.Duration) {
+	c.endpoints.mu.Lock()
+	defer c.endpoints.mu.Unlock()
+	c.endpoints.selection = selection
+	c.endpoints.failback = failback
+}
+
+// Endpoints returns the state of the masternode endpoints, in order of
+// preference.
+func (c *Client) Endpoints() []EndpointHealth {
+	c.endpoints.mu.Lock()
+	defer c.endpoints.mu.Unlock()
+	res := make([]EndpointHealth, 0, len(c.endpoints.list))
+	for idx, ep := range c.endpoints.list {
+		res = append(res, EndpointHealth{
+			URL:          ep.url,
+			Current:      idx == c.endpoints.current,
+			Healthy:      ep.healthy,
+			HealthySince: ep.healthySince,
+			Failures:     ep.failures,
+			LastError:    ep.lastError,
+		})
+	}
+	return res
+}
+
+// LastSyncs returns the sync cursor of every endpoint, by URL.
+func (c *Client) LastSyncs() map[string]int {
+	c.endpoints.mu.Lock()
+	defer c.endpoints.mu.Unlock()
+	res := make(map[string]int, len(c.endpoints.list))
+	for _, ep := range c.endpoints.list {
+		res[ep.url] = ep.lastSync
+	}
+	return res
+}
+
+// SetLastSync restores the sync cursor of an endpoint.
+func (c *Client) SetLastSync(endpointURL string, lastSync int) {
+	c.endpoints.mu.Lock()
+	defer c.endpoints.mu.Unlock()
+	for _, ep := range c.endpoints.list {
+		if ep.url == endpointURL {
+			ep.lastSync = lastSync
+		}
+	}
+}
+
+// CheckHealth probes the endpoints which aren't in use, by authenticating
+// with them, so failed ones are known to be back and failback can happen.
+func (c *Client) CheckHealth() {
+	for _, ep := range c.endpoints.probes() {
+		err := c.authenticate(ep)
+		if err != nil {
+			c.log.Warnf("Masternode %s unhealthy: %s", ep.url, err)
+		}
+	}
+}
@@ -3,95 +3,371 @@ package prot
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"io/ioutil"
+	"net"
 	"net/http"
+	"regexp"
+	"strconv"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 type Client struct {
-	client        http.Client
-	masterNodeUrl string
-	hash          string
-	apiKey        string
-	log           *logrus.Logger
+	client    http.Client
+	endpoints *endpoints
+	hash      string
+	apiKey    string
+	log       *logrus.Logger
+	transfer  *transfer
+	clock     *clock
+}
+
+// ErrNotModified is returned for conditional requests of data which hasn't
+// changed, when there is no earlier response to stand for it.
+var ErrNotModified = errors.New("not modified")
+
+const authPath = "/api/gate/auth"
+
+// secretFields matches the device keys in the bodies of the registry, which
+// are left out of the logs.
+var secretFields = regexp.MustCompile(`"(mac_key|irk)"\s*:\s*"[^"]*"`)
+
+func redact(body []byte) []byte {
+	return secretFields.ReplaceAll(body, []byte(`"$1":"[redacted]"`))
 }
 
 func NewClient(url, apiKey, hash string) Client {
 	return Client{
-		client:        http.Client{},
-		masterNodeUrl: url,
-		hash:          hash,
-		apiKey:        apiKey,
-		log:           nil,
+		client:    http.Client{},
+		endpoints: newEndpoints(url),
+		hash:      hash,
+		apiKey:    apiKey,
+		log:       nil,
+		transfer:  newTransfer(),
+		clock:     &clock{},
 	}
 }
 
+// SetTimeout bounds the time of a request, response body included. Zero
+// means no timeout.
+func (c *Client) SetTimeout(timeout time.Duration) {
+	c.client.Timeout = timeout
+}
+
+// IsTimeout tells whether a request failed for running out of time.
+func IsTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// Init authenticates the gateway with the first masternode which accepts
+// it. The other endpoints authenticate when they are first used.
 func (c *Client) Init(log *logrus.Logger) error {
 	c.log = log
-	path := "/api/gate/auth"
+	var err error
+	for _, ep := range c.endpoints.all() {
+		err = c.authenticate(ep)
+		if err == nil {
+			return nil
+		}
+		c.log.Warnf("Masternode %s auth failed: %s", ep.url, err)
+	}
+	return err
+}
+
+// authenticate authenticates the gateway with an endpoint. An endpoint
+// rejecting it counts as failed, it is of no use until the key is fixed.
+func (c *Client) authenticate(ep *endpoint) error {
 	bodyReq, err := json.Marshal(InitGateReq{c.apiKey, Gate{Hash: c.hash}})
 	if err != nil {
 		return err
 	}
 
-	_, err = c.sendRequest("POST", path, bodyReq)
-	return err
+	res, err := c.sendTo(ep, request{method: "POST", path: authPath, body: bodyReq})
+	if err != nil {
+		if statusErr, ok := err.(*StatusError); ok && !statusErr.serverError() {
+			c.endpoints.failed(ep, err)
+		}
+		return err
+	}
+	var body GateInitResponse
+	err = json.Unmarshal(res.body, &body)
+	if err == nil && body.Meta.Error != nil {
+		err = &MetaError{Endpoint: ep.url, Err: body.Meta.Error}
+	}
+	if err != nil {
+		c.endpoints.failed(ep, err)
+		return err
+	}
+	c.endpoints.succeeded(ep)
+	c.endpoints.setAuthenticated(ep, true)
+	return nil
 }
 
 func (c *Client) sendRequest(method, path string, body []byte) ([]byte, error) {
-	c.log.Debugf("gate sendRequest path: %s reqBody: %s", path, body);
-	req, err := http.NewRequest(method, c.masterNodeUrl+path, bytes.NewBuffer(body))
+	res, err := c.send(request{method: method, path: path, body: body})
+	if err != nil {
+		return nil, err
+	}
+	return res.body, nil
+}
+
+// request is a request to the masternode.
+type request struct {
+	method string
+	path   string
+	body   []byte
+	// Send the validators of the previous response of the path, an
+	// unchanged response is the previous body then.
+	conditional bool
+	// Gzip the body.
+	compress bool
+	// Add the sync cursor of the endpoint as last_sync.
+	lastSync bool
+}
+
+type response struct {
+	body        []byte
+	notModified bool
+	endpoint    *endpoint
+}
+
+// send makes a request to the selected masternode endpoint, authenticating
+// first if needed. Only requests which didn't reach a masternode are tried
+// on another one, others could be handled twice. A request refused as
+// unauthorized is sent again once, after authenticating again.
+func (c *Client) send(r request) (*response, error) {
+	tried := make(map[*endpoint]bool)
+	for {
+		ep := c.endpoints.pick(tried)
+		if ep == nil {
+			return nil, errors.New("no masternode endpoint left")
+		}
+		tried[ep] = true
+		var err error
+		if !c.endpoints.isAuthenticated(ep) {
+			err = c.authenticate(ep)
+		}
+		if err == nil {
+			var res *response
+			res, err = c.sendTo(ep, r)
+			if statusErr, ok := err.(*StatusError); ok && statusErr.Code == http.StatusUnauthorized {
+				// the masternode dropped the session
+				err = c.authenticate(ep)
+				if err == nil {
+					res, err = c.sendTo(ep, r)
+				}
+			}
+			if err == nil {
+				c.endpoints.succeeded(ep)
+				return res, nil
+			}
+		}
+		if !unreached(err) {
+			return nil, err
+		}
+		c.log.Warnf("Masternode %s unreachable: %s", ep.url, err)
+	}
+}
+
+// sendTo makes a request to an endpoint. Responses without a 2xx status,
+// besides those of unchanged data, are returned as a StatusError. Only
+// failures of the endpoint are tracked here, its success depends on what
+// the response tells.
+func (c *Client) sendTo(ep *endpoint, r request) (*response, error) {
+	res, status, err := c.do(ep, r)
 	if err != nil {
+		c.endpoints.failed(ep, err)
 		return nil, err
 	}
+	if res.notModified || status >= 200 && status < 300 {
+		return res, nil
+	}
+	statusErr := &StatusError{Endpoint: ep.url, Code: status}
+	switch {
+	case statusErr.serverError():
+		c.endpoints.failed(ep, statusErr)
+	case status == http.StatusUnauthorized:
+		// authenticate again on the next request
+		c.endpoints.setAuthenticated(ep, false)
+	}
+	return nil, statusErr
+}
+
+func (c *Client) do(ep *endpoint, r request) (*response, int, error) {
+	path := r.path
+	if r.lastSync {
+		if lastSync := c.endpoints.cursor(ep); lastSync != 0 {
+			path += "?last_sync=" + strconv.Itoa(lastSync)
+		}
+	}
+	// validators of one masternode mean nothing to another
+	key := ep.url + path
+	c.log.Debugf("gate sendRequest url: %s path: %s reqBody: %s", ep.url, path, r.body)
+	reqBody := r.body
+	if r.compress {
+		var err error
+		reqBody, err = gzipBody(r.body)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	req, err := http.NewRequest(r.method, ep.url+path, bytes.NewBuffer(reqBody))
+	if err != nil {
+		return nil, 0, err
+	}
 	req.Header.Set("Authorization", "Gateway "+c.hash)
 	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept-Encoding", "gzip")
+	if r.compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if r.conditional {
+		c.transfer.setConditional(req, key)
+	}
+	start := time.Now()
 	resp, err := c.client.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	defer resp.Body.Close()
-	body, err = ioutil.ReadAll(resp.Body)
+	c.clock.observe(resp.Header.Get("Date"), start, time.Now())
+	respBody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
+	}
+	notModified := r.conditional && resp.StatusCode == http.StatusNotModified
+	c.transfer.count(path, len(reqBody), len(respBody), notModified)
+
+	res := &response{notModified: notModified, endpoint: ep}
+	if notModified {
+		c.log.Debugf("gate sendRequest path: %s not modified", path)
+		cached, ok := c.transfer.cached(key)
+		if !ok {
+			return nil, resp.StatusCode, ErrNotModified
+		}
+		res.body = cached
+		return res, resp.StatusCode, nil
+	}
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		respBody, err = gunzipBody(respBody)
+		if err != nil {
+			return nil, resp.StatusCode, err
+		}
+	}
+	if r.conditional && resp.StatusCode == http.StatusOK {
+		c.transfer.remember(key, resp, respBody)
 	}
 
-	c.log.Debugf("gate sendRequest path: %s response: %s", path, body);
+	c.log.Debugf("gate sendRequest path: %s response: %s", path, redact(respBody))
 
-	return body, nil
+	res.body = respBody
+	return res, resp.StatusCode, nil
 }
 
-func (c *Client) SyncTransaction(transactions Transactions, lastSync int) (*SyncResponse, error) {
+// SyncTransaction sends transactions and fetches those changed since the
+// last sync with the same masternode, see LastSyncs. Transactions keep their
+// IDs when sent again, after a failure or to another masternode. Only those
+// listed by SyncResponse.Accepted were stored by the masternode.
+func (c *Client) SyncTransaction(transactions Transactions) (*SyncResponse, error) {
 	path := "/api/gate/sync"
-	if lastSync != 0 {
-		path += "?last_sync=" + string(lastSync)
-	}
 
 	reqBody, err := json.Marshal(transactions)
 	if err != nil {
 		return nil, err
 	}
 
-	body, err := c.sendRequest("POST", path, reqBody)
+	r, err := c.send(request{method: "POST", path: path, body: reqBody, compress: true, lastSync: true})
 	if err != nil {
 		return nil, err
 	}
 
 	var res SyncResponse
+	err = json.Unmarshal(r.body, &res)
+	if err != nil {
+		return &res, err
+	}
+	if res.Meta.Error != nil {
+		return &res, &MetaError{Endpoint: r.endpoint.url, Err: res.Meta.Error}
+	}
+	res.Endpoint = r.endpoint.url
+	res.ServerTime = res.latestUpdate()
+	if res.ServerTime.IsZero() {
+		res.ServerTime = c.ServerTime()
+	}
+	c.endpoints.setCursor(r.endpoint, int(res.ServerTime.Unix()))
+	return &res, nil
+}
+
+// GetDevices returns a page of the device registry, Meta.Total tells the
+// size of the whole registry. A page unchanged since it was last fetched
+// comes back with NotModified set.
+func (c *Client) GetDevices(offset, limit int) (*DeviceResponse, error) {
+	path := "/api/gate/v2/devices?offset=" + strconv.Itoa(offset) + "&limit=" + strconv.Itoa(limit)
+
+	r, err := c.send(request{method: "GET", path: path, body: []byte{}, conditional: true})
+	if err != nil {
+		return nil, err
+	}
+
+	var res DeviceResponse
+	err = json.Unmarshal(r.body, &res)
+	res.NotModified = r.notModified
+	return &res, err
+}
+
+func (c *Client) ReportPresence(presences Presences) (*BaseResponse, error) {
+	path := "/api/gate/presence"
+
+	reqBody, err := json.Marshal(presences)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := c.sendRequest("POST", path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	var res BaseResponse
 	err = json.Unmarshal(body, &res)
 	return &res, err
 }
 
-func (c *Client) GetDevices() (*DeviceResponse, error) {
-	path := "/api/gate/v2/devices"
+func (c *Client) ReportDeviceInfo(info DevicesInfo) (*BaseResponse, error) {
+	path := "/api/gate/devices/info"
 
-	body, err := c.sendRequest("GET", path, []byte{})
+	reqBody, err := json.Marshal(info)
 	if err != nil {
 		return nil, err
 	}
 
-	var res DeviceResponse
+	body, err := c.sendRequest("POST", path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	var res BaseResponse
+	err = json.Unmarshal(body, &res)
+	return &res, err
+}
+
+func (c *Client) ReportDiscovered(discovered DiscoveredDevices) (*BaseResponse, error) {
+	path := "/api/gate/discovered"
+
+	reqBody, err := json.Marshal(discovered)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := c.sendRequest("POST", path, reqBody)
+	if err != nil {
+		return nil, err
+	}
+
+	var res BaseResponse
 	err = json.Unmarshal(body, &res)
 	return &res, err
 }
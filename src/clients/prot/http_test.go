@@ -0,0 +1,369 @@
+package prot_test
+
+import (
+	"bytes"
+	"clients/prot"
+	"clients/prot/prottest"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	testAPIKey = "API_KEY"
+	testHash   = "NODE_UUID"
+)
+
+func testLogger() *logrus.Logger {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	return log
+}
+
+func newTestClient(t *testing.T, url string) *prot.Client {
+	client := prot.NewClient(url, testAPIKey, testHash)
+	err := client.Init(testLogger())
+	if err != nil {
+		t.Fatalf("init failed: %s", err)
+	}
+	return &client
+}
+
+func testTransactions(ids ...int) prot.Transactions {
+	var res prot.Transactions
+	for _, id := range ids {
+		res.Transactions = append(res.Transactions, prot.TransactionReq{
+			ID:         id,
+			Hash:       fmt.Sprintf("%064x", id),
+			DeviceHash: "aa:bb:cc:dd:ee:ff",
+			Timestamp:  time.Now().UTC(),
+			Uplink:     true,
+			Payload:    "{}",
+		})
+	}
+	return res
+}
+
+func TestSyncTransaction(t *testing.T) {
+	srv := prottest.NewServer(testAPIKey)
+	defer srv.Close()
+	client := newTestClient(t, srv.URL)
+
+	// not the IDs the masternode assigns
+	tr := testTransactions(101, 102, 103)
+	res, err := client.SyncTransaction(tr)
+	if err != nil {
+		t.Fatalf("sync failed: %s", err)
+	}
+	if got := res.Accepted(tr.Transactions); len(got) != 3 || got[0] != 101 || got[2] != 103 {
+		t.Errorf("accepted %v, want [101 102 103]", got)
+	}
+	if res.Endpoint != srv.URL {
+		t.Errorf("endpoint %q, want %q", res.Endpoint, srv.URL)
+	}
+	if n := len(srv.Transactions()); n != 3 {
+		t.Errorf("server stored %d transactions, want 3", n)
+	}
+
+	_, err = client.SyncTransaction(testTransactions(4))
+	if err != nil {
+		t.Fatalf("second sync failed: %s", err)
+	}
+	syncs := srv.RequestsTo(prottest.SyncPath)
+	if len(syncs) != 2 {
+		t.Fatalf("server received %d syncs, want 2", len(syncs))
+	}
+	if syncs[0].Query != "" {
+		t.Errorf("first sync query %q, want none", syncs[0].Query)
+	}
+	if syncs[1].Query == "" {
+		t.Errorf("second sync without last_sync")
+	}
+	if syncs[1].Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("sync body not compressed")
+	}
+}
+
+func TestSyncTransactionFaults(t *testing.T) {
+	tests := []struct {
+		name     string
+		fault    prottest.Fault
+		check    func(t *testing.T, tr prot.Transactions, res *prot.SyncResponse, err error)
+		accepted int
+		// the sync went through and moved the cursor
+		synced bool
+	}{
+		{
+			name:  "latency",
+			fault: prottest.Fault{Latency: 200 * time.Millisecond},
+			check: func(t *testing.T, tr prot.Transactions, res *prot.SyncResponse, err error) {
+				if !prot.IsTimeout(err) {
+					t.Errorf("error %v, want a timeout", err)
+				}
+			},
+			// handled by the server once the client gave up
+			accepted: 2,
+		},
+		{
+			name:  "server error",
+			fault: prottest.Fault{Status: http.StatusBadGateway},
+			check: func(t *testing.T, tr prot.Transactions, res *prot.SyncResponse, err error) {
+				statusErr, ok := err.(*prot.StatusError)
+				if !ok || statusErr.Code != http.StatusBadGateway {
+					t.Errorf("error %v, want a status error 502", err)
+				}
+			},
+		},
+		{
+			name:  "client error",
+			fault: prottest.Fault{Status: http.StatusBadRequest},
+			check: func(t *testing.T, tr prot.Transactions, res *prot.SyncResponse, err error) {
+				statusErr, ok := err.(*prot.StatusError)
+				if !ok || statusErr.Code != http.StatusBadRequest {
+					t.Errorf("error %v, want a status error 400", err)
+				}
+			},
+		},
+		{
+			name:  "malformed",
+			fault: prottest.Fault{Malformed: true},
+			check: func(t *testing.T, tr prot.Transactions, res *prot.SyncResponse, err error) {
+				if err == nil {
+					t.Errorf("malformed response accepted")
+				}
+			},
+		},
+		{
+			name:  "meta error",
+			fault: prottest.Fault{MetaError: "storage unavailable"},
+			check: func(t *testing.T, tr prot.Transactions, res *prot.SyncResponse, err error) {
+				if _, ok := err.(*prot.MetaError); !ok {
+					t.Errorf("error %v, want a meta error", err)
+				}
+			},
+			accepted: 2,
+		},
+		{
+			name:  "partial acceptance",
+			fault: prottest.Fault{Reject: 1},
+			check: func(t *testing.T, tr prot.Transactions, res *prot.SyncResponse, err error) {
+				if err != nil {
+					t.Fatalf("sync failed: %s", err)
+				}
+				if got := res.Accepted(tr.Transactions); len(got) != 1 || got[0] != 1 {
+					t.Errorf("accepted %v, want [1]", got)
+				}
+			},
+			accepted: 1,
+			synced:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := prottest.NewServer(testAPIKey)
+			defer srv.Close()
+			client := newTestClient(t, srv.URL)
+			client.SetTimeout(100 * time.Millisecond)
+			srv.Inject(prottest.SyncPath, tt.fault)
+
+			tr := testTransactions(1, 2)
+			res, err := client.SyncTransaction(tr)
+			tt.check(t, tr, res, err)
+			if moved := client.LastSyncs()[srv.URL] != 0; moved != tt.synced {
+				t.Errorf("cursor moved %t, want %t", moved, tt.synced)
+			}
+			if tt.fault.Latency > 0 {
+				time.Sleep(2 * tt.fault.Latency)
+			}
+			if n := len(srv.Transactions()); n != tt.accepted {
+				t.Errorf("server stored %d transactions, want %d", n, tt.accepted)
+			}
+		})
+	}
+}
+
+func TestAcceptedWithoutHashes(t *testing.T) {
+	tr := testTransactions(1, 2)
+	res := prot.SyncResponse{Data: []prot.SyncResponseData{{
+		Results: []prot.TransactionRes{{ID: 7}},
+	}}}
+	if got := res.Accepted(tr.Transactions); len(got) != 2 {
+		t.Errorf("accepted %v, want all of them", got)
+	}
+	res.Data = nil
+	if got := res.Accepted(tr.Transactions); len(got) != 2 {
+		t.Errorf("accepted %v without results, want all of them", got)
+	}
+}
+
+func TestSyncTransactionUnauthorized(t *testing.T) {
+	srv := prottest.NewServer(testAPIKey)
+	defer srv.Close()
+	client := newTestClient(t, srv.URL)
+
+	// the session is dropped, the sync goes through after authenticating
+	srv.Inject(prottest.SyncPath, prottest.Fault{Status: http.StatusUnauthorized})
+	_, err := client.SyncTransaction(testTransactions(1))
+	if err != nil {
+		t.Fatalf("sync failed: %s", err)
+	}
+	if n := len(srv.RequestsTo(prottest.AuthPath)); n != 2 {
+		t.Errorf("server received %d auths, want 2", n)
+	}
+	if n := len(srv.Transactions()); n != 1 {
+		t.Errorf("server stored %d transactions, want 1", n)
+	}
+
+	// retried once only
+	cursor := client.LastSyncs()[srv.URL]
+	srv.Inject(prottest.SyncPath,
+		prottest.Fault{Status: http.StatusUnauthorized}, prottest.Fault{Status: http.StatusUnauthorized})
+	_, err = client.SyncTransaction(testTransactions(2))
+	statusErr, ok := err.(*prot.StatusError)
+	if !ok || statusErr.Code != http.StatusUnauthorized {
+		t.Errorf("error %v, want a status error 401", err)
+	}
+	if n := len(srv.RequestsTo(prottest.SyncPath)); n != 4 {
+		t.Errorf("server received %d syncs, want 4", n)
+	}
+	if client.LastSyncs()[srv.URL] != cursor {
+		t.Errorf("cursor moved by a refused sync")
+	}
+}
+
+func TestInitRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		apiKey string
+		fault  prottest.Fault
+	}{
+		{name: "invalid api key", apiKey: "WRONG_KEY"},
+		{name: "forbidden", apiKey: testAPIKey, fault: prottest.Fault{Status: http.StatusForbidden}},
+		{name: "meta error", apiKey: testAPIKey, fault: prottest.Fault{MetaError: "gateway disabled"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := prottest.NewServer(testAPIKey)
+			defer srv.Close()
+			srv.Inject(prottest.AuthPath, tt.fault)
+
+			client := prot.NewClient(srv.URL, tt.apiKey, testHash)
+			err := client.Init(testLogger())
+			if err == nil {
+				t.Fatalf("init succeeded")
+			}
+			if client.Endpoints()[0].Healthy {
+				t.Errorf("rejecting endpoint healthy")
+			}
+		})
+	}
+}
+
+func TestCheckHealthRejected(t *testing.T) {
+	srv := prottest.NewServer(testAPIKey)
+	defer srv.Close()
+	other := prottest.NewServer("OTHER_KEY")
+	defer other.Close()
+
+	client := prot.NewClient(srv.URL, testAPIKey, testHash)
+	client.AddEndpoints(other.URL)
+	err := client.Init(testLogger())
+	if err != nil {
+		t.Fatalf("init failed: %s", err)
+	}
+	client.CheckHealth()
+	health := client.Endpoints()
+	if !health[0].Healthy || health[1].Healthy {
+		t.Errorf("endpoints %+v, want the rejecting one unhealthy", health)
+	}
+}
+
+func TestSyncTransactionFailover(t *testing.T) {
+	down := prottest.NewServer(testAPIKey)
+	downURL := down.URL
+	down.Close()
+	srv := prottest.NewServer(testAPIKey)
+	defer srv.Close()
+
+	client := prot.NewClient(downURL, testAPIKey, testHash)
+	client.AddEndpoints(srv.URL)
+	err := client.Init(testLogger())
+	if err != nil {
+		t.Fatalf("init failed: %s", err)
+	}
+	res, err := client.SyncTransaction(testTransactions(1))
+	if err != nil {
+		t.Fatalf("sync failed: %s", err)
+	}
+	if res.Endpoint != srv.URL {
+		t.Errorf("synced with %q, want %q", res.Endpoint, srv.URL)
+	}
+	health := client.Endpoints()
+	if health[0].Healthy || !health[1].Healthy || !health[1].Current {
+		t.Errorf("endpoints %+v, want the second current and healthy only", health)
+	}
+}
+
+func TestGetDevicesRedacted(t *testing.T) {
+	srv := prottest.NewServer(testAPIKey)
+	defer srv.Close()
+	srv.SetRegistry([]prot.Device{{
+		Hash:          "aa:bb:cc:dd:ee:ff",
+		DeviceGroupID: "g1",
+		MacKey:        "00112233445566778899aabbccddeeff",
+		IRK:           "ffeeddccbbaa99887766554433221100",
+	}}, []prot.DeviceGroup{{ExonumID: "g1"}})
+	var logged bytes.Buffer
+	log := testLogger()
+	log.Out = &logged
+	log.Level = logrus.DebugLevel
+	client := prot.NewClient(srv.URL, testAPIKey, testHash)
+	err := client.Init(log)
+	if err != nil {
+		t.Fatalf("init failed: %s", err)
+	}
+
+	res, err := client.GetDevices(0, 10)
+	if err != nil {
+		t.Fatalf("get devices failed: %s", err)
+	}
+	if d := res.Data[0].Devices[0]; d.MacKey == "" || d.IRK == "" {
+		t.Errorf("device %+v without its keys", d)
+	}
+	for _, key := range []string{"00112233445566778899aabbccddeeff", "ffeeddccbbaa99887766554433221100"} {
+		if strings.Contains(logged.String(), key) {
+			t.Errorf("key %s logged", key)
+		}
+	}
+	if !strings.Contains(logged.String(), "[redacted]") {
+		t.Errorf("response body not logged")
+	}
+}
+
+func TestGetDevicesNotModified(t *testing.T) {
+	srv := prottest.NewServer(testAPIKey)
+	defer srv.Close()
+	srv.SetRegistry([]prot.Device{{Hash: "aa:bb:cc:dd:ee:ff", DeviceGroupID: "g1"}},
+		[]prot.DeviceGroup{{ExonumID: "g1"}})
+	client := newTestClient(t, srv.URL)
+
+	res, err := client.GetDevices(0, 10)
+	if err != nil {
+		t.Fatalf("get devices failed: %s", err)
+	}
+	if res.NotModified || len(res.Data) != 1 || len(res.Data[0].Devices) != 1 {
+		t.Fatalf("unexpected first page %+v", res)
+	}
+	res, err = client.GetDevices(0, 10)
+	if err != nil {
+		t.Fatalf("get devices failed: %s", err)
+	}
+	if !res.NotModified || len(res.Data) != 1 || len(res.Data[0].Devices) != 1 {
+		t.Errorf("unchanged page %+v, want the previous one not modified", res)
+	}
+}
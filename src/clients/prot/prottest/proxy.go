@@ -0,0 +1,280 @@
+package prottest
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Proxy is a stand-in HTTP CONNECT or SOCKS5 proxy listening on a local
+// port, to go through on the way to a Server.
+//
+//	proxy := prottest.NewSOCKS5Proxy("user", "secret")
+//	defer proxy.Close()
+//	client.SetTransport(prot.TransportConfig{
+//		Kind: prot.TransportSOCKS5, Address: proxy.Addr,
+//		Username: "user", Password: "secret",
+//	})
+type Proxy struct {
+	// Addr is the host:port of the proxy.
+	Addr string
+
+	listener  net.Listener
+	username  string
+	password  string
+	handshake func(p *Proxy, conn net.Conn, r *bufio.Reader) (net.Conn, error)
+
+	mu       sync.Mutex
+	targets  []string
+	failures int
+}
+
+// NewConnectProxy starts an HTTP proxy tunneling with CONNECT. Requests
+// must carry the credentials, unless username is empty.
+func NewConnectProxy(username, password string) *Proxy {
+	return newProxy(username, password, connectHandshake)
+}
+
+// NewSOCKS5Proxy starts a SOCKS5 proxy. Clients must authenticate with the
+// credentials, unless username is empty.
+func NewSOCKS5Proxy(username, password string) *Proxy {
+	return newProxy(username, password, socks5Handshake)
+}
+
+func newProxy(username, password string, handshake func(*Proxy, net.Conn, *bufio.Reader) (net.Conn, error)) *Proxy {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("prottest: failed to listen: " + err.Error())
+	}
+	p := &Proxy{
+		Addr:      listener.Addr().String(),
+		listener:  listener,
+		username:  username,
+		password:  password,
+		handshake: handshake,
+	}
+	go p.serve()
+	return p
+}
+
+// Close stops the proxy from accepting connections.
+func (p *Proxy) Close() {
+	p.listener.Close()
+}
+
+// Targets returns the addresses tunneled to so far, in order.
+func (p *Proxy) Targets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]string(nil), p.targets...)
+}
+
+// Failures returns the number of handshakes refused, for bad credentials,
+// invalid requests or targets which couldn't be reached.
+func (p *Proxy) Failures() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.failures
+}
+
+func (p *Proxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.tunnel(conn)
+	}
+}
+
+func (p *Proxy) tunnel(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	upstream, err := p.handshake(p, conn, r)
+	if err != nil {
+		p.mu.Lock()
+		p.failures++
+		p.mu.Unlock()
+		return
+	}
+	defer upstream.Close()
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, r)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// dial connects to the target of a tunnel, before the handshake answers.
+func (p *Proxy) dial(target string) (net.Conn, error) {
+	p.mu.Lock()
+	p.targets = append(p.targets, target)
+	p.mu.Unlock()
+	return net.Dial("tcp", target)
+}
+
+func (p *Proxy) authorized(username, password string) bool {
+	return p.username == "" || username == p.username && password == p.password
+}
+
+// connectHandshake answers a CONNECT request.
+func connectHandshake(p *Proxy, conn net.Conn, r *bufio.Reader) (net.Conn, error) {
+	req, err := http.ReadRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if req.Method != http.MethodConnect {
+		io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+		return nil, errors.New("not a CONNECT request")
+	}
+	username, password := proxyCredentials(req)
+	if !p.authorized(username, password) {
+		io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+			"Proxy-Authenticate: Basic realm=\"prottest\"\r\n\r\n")
+		return nil, errors.New("proxy authentication failed")
+	}
+	upstream, err := p.dial(req.Host)
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+		return nil, err
+	}
+	_, err = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	if err != nil {
+		upstream.Close()
+		return nil, err
+	}
+	return upstream, nil
+}
+
+func proxyCredentials(req *http.Request) (string, string) {
+	const prefix = "Basic "
+	auth := req.Header.Get("Proxy-Authorization")
+	if len(auth) < len(prefix) || auth[:len(prefix)] != prefix {
+		return "", ""
+	}
+	b, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", ""
+	}
+	for i := range b {
+		if b[i] == ':' {
+			return string(b[:i]), string(b[i+1:])
+		}
+	}
+	return "", ""
+}
+
+// socks5Handshake negotiates a CONNECT command, see RFC 1928 and RFC 1929.
+func socks5Handshake(p *Proxy, conn net.Conn, r *bufio.Reader) (net.Conn, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+	methods := make([]byte, header[1])
+	_, err = io.ReadFull(r, methods)
+	if err != nil {
+		return nil, err
+	}
+	method := byte(0xff)
+	want := byte(0)
+	if p.username != "" {
+		want = 2
+	}
+	for _, m := range methods {
+		if m == want {
+			method = want
+		}
+	}
+	_, err = conn.Write([]byte{5, method})
+	if err != nil || method == 0xff {
+		return nil, errors.New("no acceptable authentication method")
+	}
+	if method == 2 {
+		username, err := readField(r, 1)
+		if err != nil {
+			return nil, err
+		}
+		password, err := readField(r, 0)
+		if err != nil {
+			return nil, err
+		}
+		if !p.authorized(username, password) {
+			conn.Write([]byte{1, 1})
+			return nil, errors.New("proxy authentication failed")
+		}
+		_, err = conn.Write([]byte{1, 0})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	req := make([]byte, 4)
+	_, err = io.ReadFull(r, req)
+	if err != nil {
+		return nil, err
+	}
+	var host string
+	switch req[3] {
+	case 1, 4:
+		ip := make([]byte, net.IPv4len)
+		if req[3] == 4 {
+			ip = make([]byte, net.IPv6len)
+		}
+		_, err = io.ReadFull(r, ip)
+		host = net.IP(ip).String()
+	case 3:
+		host, err = readField(r, 0)
+	default:
+		err = errors.New("invalid address type")
+	}
+	if err != nil {
+		return nil, err
+	}
+	port := make([]byte, 2)
+	_, err = io.ReadFull(r, port)
+	if err != nil {
+		return nil, err
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	if req[1] != 1 {
+		conn.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+		return nil, errors.New("command not supported")
+	}
+	upstream, err := p.dial(target)
+	if err != nil {
+		// connection refused
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return nil, err
+	}
+	_, err = conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	if err != nil {
+		upstream.Close()
+		return nil, err
+	}
+	return upstream, nil
+}
+
+// readField reads a field prefixed with its length, after skipping some
+// bytes.
+func readField(r *bufio.Reader, skip int) (string, error) {
+	b := make([]byte, skip+1)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return "", err
+	}
+	field := make([]byte, b[skip])
+	_, err = io.ReadFull(r, field)
+	return string(field), err
+}
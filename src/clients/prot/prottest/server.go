@@ -0,0 +1,386 @@
+// Package prottest provides a fake masternode for exercising prot.Client and
+// the sdk loops without a real server.
+//
+//	srv := prottest.NewServer("API_KEY")
+//	defer srv.Close()
+//	srv.SetRegistry(devices, deviceGroups)
+//	srv.Inject("/api/gate/sync", prottest.Fault{Status: http.StatusBadGateway})
+//	client := prot.NewClient(srv.URL, "API_KEY", "NODE_UUID")
+//
+// Responses use the BaseResponse envelope of the masternode. Faults are
+// queued per path and each applies to one request; every request is
+// recorded, bodies decompressed.
+package prottest
+
+import (
+	"bytes"
+	"clients/prot"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Paths served.
+const (
+	AuthPath       = "/api/gate/auth"
+	SyncPath       = "/api/gate/sync"
+	DevicesPath    = "/api/gate/v2/devices"
+	PresencePath   = "/api/gate/presence"
+	InfoPath       = "/api/gate/devices/info"
+	DiscoveredPath = "/api/gate/discovered"
+)
+
+// Fault alters the response to a request. The zero value changes nothing.
+type Fault struct {
+	// Delay before the response is written.
+	Latency time.Duration
+	// Status code to answer with instead of handling the request, along
+	// with an envelope carrying an error.
+	Status int
+	// Answer with a body which isn't JSON.
+	Malformed bool
+	// Handle the request but set Meta.Error of the response.
+	MetaError interface{}
+	// Syncs only: the number of transactions at the end of the request which
+	// are left out of the results and not accepted.
+	Reject int
+}
+
+// Request is a request received by the server.
+type Request struct {
+	Method string
+	Path   string
+	Query  string
+	Header http.Header
+	// Body, decompressed if it was sent with gzip.
+	Body []byte
+	At   time.Time
+}
+
+// Server is a fake masternode listening on a local port.
+type Server struct {
+	*httptest.Server
+
+	mu           sync.Mutex
+	apiKey       string
+	devices      []prot.Device
+	deviceGroups []prot.DeviceGroup
+	// version of the registry, in the ETags of the device pages
+	version      int
+	faults       map[string][]Fault
+	requests     []Request
+	transactions []prot.TransactionReq
+	nextID       int
+}
+
+// NewServer starts a masternode accepting gateways with apiKey.
+func NewServer(apiKey string) *Server {
+	s := NewUnstartedServer(apiKey)
+	s.Start()
+	return s
+}
+
+// NewTLSServer starts a masternode serving HTTPS with a self-signed
+// certificate, see httptest.Server.Certificate.
+func NewTLSServer(apiKey string) *Server {
+	s := NewUnstartedServer(apiKey)
+	s.StartTLS()
+	return s
+}
+
+// NewUnixServer starts a masternode listening on a Unix domain socket at
+// path. Its URL has "unix" as host, which the unix transport ignores.
+func NewUnixServer(apiKey, path string) *Server {
+	s := NewUnstartedServer(apiKey)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		panic("prottest: failed to listen on " + path + ": " + err.Error())
+	}
+	s.Listener.Close()
+	s.Listener = listener
+	s.Start()
+	s.URL = "http://unix"
+	return s
+}
+
+// NewUnstartedServer returns a masternode to be started with Start or
+// StartTLS, e.g. after setting its TLS config to require client
+// certificates.
+func NewUnstartedServer(apiKey string) *Server {
+	s := &Server{
+		apiKey: apiKey,
+		faults: make(map[string][]Fault),
+		nextID: 1,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(AuthPath, s.handle(s.auth))
+	mux.HandleFunc(SyncPath, s.handle(s.sync))
+	mux.HandleFunc(DevicesPath, s.handle(s.getDevices))
+	mux.HandleFunc(PresencePath, s.handle(s.accept))
+	mux.HandleFunc(InfoPath, s.handle(s.accept))
+	mux.HandleFunc(DiscoveredPath, s.handle(s.accept))
+	s.Server = httptest.NewUnstartedServer(mux)
+	return s
+}
+
+// SetRegistry replaces the device registry, which changes the ETags of its
+// pages.
+func (s *Server) SetRegistry(devices []prot.Device, deviceGroups []prot.DeviceGroup) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.devices = devices
+	s.deviceGroups = deviceGroups
+	s.version++
+}
+
+// Inject queues faults for the next requests of a path, one per request.
+func (s *Server) Inject(path string, faults ...Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[path] = append(s.faults[path], faults...)
+}
+
+// Requests returns the requests received so far, in order.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// RequestsTo returns the requests received so far for a path.
+func (s *Server) RequestsTo(path string) []Request {
+	var res []Request
+	for _, r := range s.Requests() {
+		if r.Path == path {
+			res = append(res, r)
+		}
+	}
+	return res
+}
+
+// Transactions returns the transactions accepted so far, in order.
+func (s *Server) Transactions() []prot.TransactionReq {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]prot.TransactionReq(nil), s.transactions...)
+}
+
+// handler handles a request which passed the faults, and returns the data
+// of the response envelope and its Meta.
+type handler func(w http.ResponseWriter, req Request, fault Fault) (interface{}, prot.Meta, int)
+
+func (s *Server) handle(h handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, err := s.record(r)
+		if err != nil {
+			writeEnvelope(w, http.StatusBadRequest, nil, prot.Meta{Error: err.Error()})
+			return
+		}
+		fault := s.nextFault(req.Path)
+		if fault.Latency > 0 {
+			time.Sleep(fault.Latency)
+		}
+		switch {
+		case fault.Status != 0:
+			writeEnvelope(w, fault.Status, nil, prot.Meta{Error: http.StatusText(fault.Status)})
+			return
+		case fault.Malformed:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"meta": {"total": `))
+			return
+		}
+		if req.Path != AuthPath && r.Header.Get("Authorization") == "" {
+			writeEnvelope(w, http.StatusUnauthorized, nil, prot.Meta{Error: "missing gateway authorization"})
+			return
+		}
+		data, meta, status := h(w, req, fault)
+		if status == http.StatusNotModified {
+			w.WriteHeader(status)
+			return
+		}
+		if fault.MetaError != nil {
+			meta.Error = fault.MetaError
+		}
+		writeEnvelope(w, status, data, meta)
+	}
+}
+
+// record stores the request, with its body decompressed.
+func (s *Server) record(r *http.Request) (Request, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return Request{}, err
+	}
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return Request{}, err
+		}
+		body, err = ioutil.ReadAll(gz)
+		if err != nil {
+			return Request{}, err
+		}
+	}
+	req := Request{
+		Method: r.Method,
+		Path:   r.URL.Path,
+		Query:  r.URL.RawQuery,
+		Header: r.Header,
+		Body:   body,
+		At:     time.Now(),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, req)
+	return req, nil
+}
+
+func (s *Server) nextFault(path string) Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	queue := s.faults[path]
+	if len(queue) == 0 {
+		return Fault{}
+	}
+	s.faults[path] = queue[1:]
+	return queue[0]
+}
+
+func writeEnvelope(w http.ResponseWriter, status int, data interface{}, meta prot.Meta) {
+	if data == nil {
+		data = []interface{}{}
+	}
+	body, err := json.Marshal(map[string]interface{}{"meta": meta, "data": data})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func (s *Server) auth(w http.ResponseWriter, req Request, fault Fault) (interface{}, prot.Meta, int) {
+	var body prot.InitGateReq
+	err := json.Unmarshal(req.Body, &body)
+	if err != nil {
+		return nil, prot.Meta{Error: err.Error()}, http.StatusBadRequest
+	}
+	if body.APIKey != s.apiKey {
+		return nil, prot.Meta{Error: "invalid api key"}, http.StatusUnauthorized
+	}
+	now := time.Now().UTC()
+	data := []prot.GateInitResponseData{{
+		ID:        1,
+		Hash:      body.Gate.Hash,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}}
+	return data, prot.Meta{Total: 1, Count: 1}, http.StatusOK
+}
+
+func (s *Server) sync(w http.ResponseWriter, req Request, fault Fault) (interface{}, prot.Meta, int) {
+	var body prot.Transactions
+	err := json.Unmarshal(req.Body, &body)
+	if err != nil {
+		return nil, prot.Meta{Error: err.Error()}, http.StatusBadRequest
+	}
+	accepted := body.Transactions
+	if fault.Reject > 0 {
+		n := len(accepted) - fault.Reject
+		if n < 0 {
+			n = 0
+		}
+		accepted = accepted[:n]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	results := make([]prot.TransactionRes, 0, len(accepted))
+	for _, t := range accepted {
+		results = append(results, prot.TransactionRes{
+			ID:         s.nextID,
+			DeviceHash: t.DeviceHash,
+			GatewayID:  1,
+			Hash:       t.Hash,
+			Timestamp:  t.Timestamp,
+			Status:     t.Status,
+			Uplink:     t.Uplink,
+			Payload:    t.Payload,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		})
+		s.nextID++
+	}
+	s.transactions = append(s.transactions, accepted...)
+	data := []prot.SyncResponseData{{
+		UpdatedUplink: []prot.TransactionRes{},
+		Changed:       []prot.TransactionRes{},
+		Uplink:        []prot.TransactionRes{},
+		Results:       results,
+	}}
+	return data, prot.Meta{Total: len(results), Count: len(results)}, http.StatusOK
+}
+
+// getDevices serves a page of the registry, with the ETag of the registry
+// version and page bounds.
+func (s *Server) getDevices(w http.ResponseWriter, req Request, fault Fault) (interface{}, prot.Meta, int) {
+	query, _ := url.ParseQuery(req.Query)
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = 100
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	etag := fmt.Sprintf(`"%d-%d-%d"`, s.version, offset, limit)
+	w.Header().Set("ETag", etag)
+	if req.Header.Get("If-None-Match") == etag {
+		return nil, prot.Meta{}, http.StatusNotModified
+	}
+	if offset > len(s.devices) {
+		offset = len(s.devices)
+	}
+	end := offset + limit
+	if end > len(s.devices) {
+		end = len(s.devices)
+	}
+	page := s.devices[offset:end]
+	// the groups of the devices on the page
+	groupIDs := make(map[string]bool)
+	for _, d := range page {
+		groupIDs[strings.ToLower(d.DeviceGroupID)] = true
+	}
+	groups := []prot.DeviceGroup{}
+	for _, g := range s.deviceGroups {
+		if groupIDs[strings.ToLower(g.ExonumID)] {
+			groups = append(groups, g)
+		}
+	}
+	data := []prot.DeviceResponseData{{
+		Devices:      append([]prot.Device{}, page...),
+		DeviceGroups: groups,
+	}}
+	return data, prot.Meta{Total: len(s.devices), Count: len(page), Offset: offset}, http.StatusOK
+}
+
+// accept answers the reports of the gateway, checking they are JSON.
+func (s *Server) accept(w http.ResponseWriter, req Request, fault Fault) (interface{}, prot.Meta, int) {
+	var body interface{}
+	err := json.Unmarshal(req.Body, &body)
+	if err != nil {
+		return nil, prot.Meta{Error: err.Error()}, http.StatusBadRequest
+	}
+	return nil, prot.Meta{}, http.StatusOK
+}
@@ -4,7 +4,7 @@ import "time"
 
 type TransactionReq struct {
 	ID         int       `json:"id"`
-	//Hash       string    `json:"hash"`
+	Hash       string    `json:"hash"`
 	DeviceHash string    `json:"device_hash"`
 	Timestamp  time.Time `json:"timestamp"`
 	Uplink     bool      `json:"uplink"`
@@ -24,3 +24,49 @@ type InitGateReq struct {
 type Gate struct {
 	Hash string `json:"hash"`
 }
+
+type PresenceReq struct {
+	DeviceHash  string     `json:"device_hash"`
+	LastSeen    time.Time  `json:"last_seen"`
+	RSSI        float64    `json:"rssi"`
+	AdvCount    int        `json:"adv_count"`
+	AdvWindow   int        `json:"adv_window"`
+	LastSession *time.Time `json:"last_session"`
+}
+
+type Presences struct {
+	Presence []PresenceReq `json:"presence"`
+}
+
+type DeviceInfoReq struct {
+	DeviceHash       string     `json:"device_hash"`
+	ManufacturerName string     `json:"manufacturer_name"`
+	ModelNumber      string     `json:"model_number"`
+	SerialNumber     string     `json:"serial_number"`
+	HardwareRevision string     `json:"hardware_revision"`
+	FirmwareRevision string     `json:"firmware_revision"`
+	SoftwareRevision string     `json:"software_revision"`
+	BatteryLevel     *int       `json:"battery_level"`
+	FirstSession     *time.Time `json:"first_session"`
+	LastSession      *time.Time `json:"last_session"`
+	UpdatedAt        time.Time  `json:"updated_at"`
+}
+
+type DiscoveredReq struct {
+	Address   string    `json:"address"`
+	Name      string    `json:"name"`
+	RSSI      int       `json:"rssi"`
+	Services  []string  `json:"services"`
+	CompanyID *int      `json:"company_id"`
+	AdvCount  int       `json:"adv_count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+type DiscoveredDevices struct {
+	Devices []DiscoveredReq `json:"devices"`
+}
+
+type DevicesInfo struct {
+	Devices []DeviceInfoReq `json:"devices"`
+}
@@ -2,6 +2,7 @@ package prot
 
 import (
 	"encoding/json"
+	"fmt"
 	"time"
 )
 
@@ -12,6 +13,16 @@ type Meta struct {
 	Error  interface{} `json:"error"`
 }
 
+// MetaError is returned for responses reporting an error in Meta.Error.
+type MetaError struct {
+	Endpoint string
+	Err      interface{}
+}
+
+func (e *MetaError) Error() string {
+	return fmt.Sprintf("%s answered error: %v", e.Endpoint, e.Err)
+}
+
 type BaseResponse struct {
 	Meta Meta            `json:"meta"`
 	Data json.RawMessage `json:"data"`
@@ -20,6 +31,48 @@ type BaseResponse struct {
 type SyncResponse struct {
 	BaseResponse
 	Data []SyncResponseData `json:"data"`
+	// ServerTime is when the masternode handled the sync by its own clock,
+	// the last_sync of the next one with the same Endpoint.
+	ServerTime time.Time `json:"-"`
+	Endpoint   string    `json:"-"`
+}
+
+// latestUpdate returns the latest update time of the transactions in the
+// response, zero when there are none.
+func (r *SyncResponse) latestUpdate() time.Time {
+	var latest time.Time
+	for _, d := range r.Data {
+		for _, list := range [][]TransactionRes{d.UpdatedUplink, d.Changed, d.Uplink, d.Results} {
+			for _, t := range list {
+				if t.UpdatedAt.After(latest) {
+					latest = t.UpdatedAt
+				}
+			}
+		}
+	}
+	return latest
+}
+
+// Accepted returns the IDs of the sent transactions the masternode
+// acknowledged in the results, matched by hash as the results carry the IDs
+// of the masternode. Those left out weren't stored and must be sent again. A
+// response without hashes in the results acknowledges all of them.
+func (r *SyncResponse) Accepted(sent []TransactionReq) []int {
+	acked := make(map[string]bool)
+	for _, d := range r.Data {
+		for _, t := range d.Results {
+			if t.Hash != "" {
+				acked[t.Hash] = true
+			}
+		}
+	}
+	ids := make([]int, 0, len(sent))
+	for _, t := range sent {
+		if len(acked) == 0 || acked[t.Hash] {
+			ids = append(ids, t.ID)
+		}
+	}
+	return ids
 }
 
 type GateInitResponse struct {
@@ -54,6 +107,8 @@ type TransactionRes struct {
 	InvoiceID       *string    `json:"invoice_id"`
 }
 
+// SyncResponseData lists the transactions changed on the masternode, and in
+// Results those of the request it accepted, with the hashes of the request.
 type SyncResponseData struct {
 	UpdatedUplink []TransactionRes `json:"updatedUplink"`
 	Changed       []TransactionRes `json:"changed"`
@@ -62,16 +117,193 @@ type SyncResponseData struct {
 }
 
 type DeviceGroup struct {
-	ID               string    `json:"id"`
-	Name             string    `json:"name"`
-	GroupType        int       `json:"group_type"`
-	UplinkLifetime   int       `json:"uplink_lifetime"`
-	DownlinkLifetime int       `json:"downlink_lifetime"`
-	Services         []Service `json:"services"`
-	CreatedAt        time.Time `json:"created_at"`
-	UpdatedAt        time.Time `json:"updated_at"`
-	ExonumID         string    `json:"exonum_id"`
-	OwnerKey         string    `json:"owner_key"`
+	ID               string              `json:"id"`
+	Name             string              `json:"name"`
+	GroupType        int                 `json:"group_type"`
+	UplinkLifetime   int                 `json:"uplink_lifetime"`
+	DownlinkLifetime int                 `json:"downlink_lifetime"`
+	Services         []Service           `json:"services"`
+	CreatedAt        time.Time           `json:"created_at"`
+	UpdatedAt        time.Time           `json:"updated_at"`
+	ExonumID         string              `json:"exonum_id"`
+	OwnerKey         string              `json:"owner_key"`
+	Settings         DeviceGroupSettings `json:"settings"`
+}
+
+// DeviceGroupSettings tune how the gateway handles the devices of a group.
+// Zero values fall back to the gateway defaults.
+type DeviceGroupSettings struct {
+	// Connection cooldowns, in seconds.
+	SuccessInterval int `json:"success_interval"`
+	FailureInterval int `json:"failure_interval"`
+	MaxBackoff      int `json:"max_backoff"`
+	// A device not seen for longer than ExpectedInterval seconds is
+	// reported offline. Zero disables the check.
+	ExpectedInterval int `json:"expected_interval"`
+	// Verification of characteristics flagged mac.
+	Mac MacSettings `json:"mac"`
+	// Steps run at the start of every session, before the characteristics
+	// are read and subscribed.
+	Procedure []ProcedureStep `json:"procedure"`
+	// Write the gateway time to the device on connect, nil disables it.
+	TimeSync *TimeSyncSettings `json:"time_sync"`
+	// Stream frames over the Nordic UART Service, nil disables it.
+	UART *UARTSettings `json:"uart"`
+	// Beacon-only group, nil for groups of connectable devices.
+	Beacon *BeaconSettings `json:"beacon"`
+	// How advertisements are matched to the devices of the group.
+	Match MatchSettings `json:"match"`
+	// Transactions of "high" priority groups are synced right away, even
+	// outside the sync windows and over the bandwidth budget. Others are
+	// "normal".
+	Priority string `json:"priority"`
+}
+
+// Sync priorities of device groups.
+const (
+	PriorityNormal = "normal"
+	PriorityHigh   = "high"
+)
+
+// Strategies of matching advertisements to devices.
+const (
+	MatchMAC              = "mac"
+	MatchIRK              = "irk"
+	MatchManufacturerData = "manufacturer_data"
+	MatchServiceData      = "service_data"
+)
+
+// MatchSettings select what identifies a device in its advertisements. With
+// the mac strategy (default) the device hash is its address. With irk the
+// resolvable private addresses of the device are resolved with its IRK.
+// Otherwise the device hash is the hex encoded ID field found at Offset in
+// the manufacturer data, after the company ID, or in the service data.
+type MatchSettings struct {
+	Strategy string `json:"strategy"`
+	// Company ID the manufacturer data must have, any when zero.
+	CompanyID int `json:"company_id"`
+	// Service UUID of the service data.
+	Service string `json:"service"`
+	// Position and size in bytes of the ID field, the rest of the data by
+	// default.
+	Offset int `json:"offset"`
+	Length int `json:"length"`
+}
+
+// Beacon frame types.
+const (
+	BeaconIBeacon      = "ibeacon"
+	BeaconAltBeacon    = "altbeacon"
+	BeaconEddystoneUID = "eddystone_uid"
+	BeaconEddystoneURL = "eddystone_url"
+	BeaconEddystoneTLM = "eddystone_tlm"
+	BeaconEddystoneEID = "eddystone_eid"
+)
+
+// BeaconSettings make a group beacon-only. Its devices are never connected,
+// the beacon frames they advertise are sent instead. Device hashes of such
+// a group are either MAC addresses or beacon identities:
+//
+//	ibeacon:<uuid>:<major>:<minor>
+//	altbeacon:<id1>:<id2>:<id3>
+//	eddystone:<namespace>:<instance>
+//	eddystone-eid:<ephemeral id>
+//
+// Trailing parts may be left out to match e.g. every major and minor of an
+// iBeacon UUID.
+type BeaconSettings struct {
+	// Frame types to send, all of them by default.
+	Types []string `json:"types"`
+	// Minimum seconds between transactions of a beacon and frame type,
+	// 60 by default.
+	Interval int `json:"interval"`
+}
+
+// Framings of the UART transport.
+const (
+	FramingLengthPrefixed = "length_prefixed"
+	FramingNewline        = "newline"
+	FramingSLIP           = "slip"
+	FramingCOBS           = "cobs"
+)
+
+// UARTSettings describe a framed protocol over a pair of RX/TX
+// characteristics. Every frame received on TX is sent as a transaction.
+type UARTSettings struct {
+	// Service and characteristics, the Nordic UART Service ones by default.
+	Service string `json:"service"`
+	RX      string `json:"rx"`
+	TX      string `json:"tx"`
+	Framing string `json:"framing"`
+	// Size of the length prefix in bytes: 1, 2 (default) or 4.
+	LengthSize      int  `json:"length_size"`
+	LengthBigEndian bool `json:"length_big_endian"`
+	// Hex encoded request frames written to RX once subscribed to TX.
+	Requests []string `json:"requests"`
+	// Longer frames are dropped, 4096 bytes by default.
+	MaxFrame int `json:"max_frame"`
+}
+
+// Time formats of the time sync characteristic.
+const (
+	TimeFormatCurrentTime = "current_time"
+	TimeFormatUnix32LE    = "unix32le"
+	TimeFormatUnix32BE    = "unix32be"
+	TimeFormatUnixMs64LE  = "unix_ms64le"
+)
+
+// TimeSyncSettings select the characteristic the gateway time is written to.
+// Without a characteristic the standard Current Time Service is used.
+type TimeSyncSettings struct {
+	Service        string `json:"service"`
+	Characteristic string `json:"characteristic"`
+	Format         string `json:"format"`
+}
+
+// MacSettings describe the tag devices append to authenticated values.
+type MacSettings struct {
+	// "hmac-sha256" (default) or "cmac-aes128".
+	Algorithm string `json:"algorithm"`
+	// Length of the tag in bytes, 4 by default.
+	TagLength int `json:"tag_length"`
+	// Drop values that fail verification instead of sending them as is.
+	DropUnauthenticated bool `json:"drop_unauthenticated"`
+}
+
+// Operations of a procedure step.
+const (
+	OpWrite                = "write"
+	OpWriteWithoutResponse = "write_without_response"
+	OpRead                 = "read"
+	OpWaitNotification     = "wait_notification"
+	OpDelay                = "delay"
+	OpBranch               = "branch"
+)
+
+// ProcedureStep is a single step of a scripted GATT procedure.
+type ProcedureStep struct {
+	// Name identifies the step result in conditions and in the transaction.
+	Name           string `json:"name"`
+	Op             string `json:"op"`
+	Service        string `json:"service"`
+	Characteristic string `json:"characteristic"`
+	// Hex encoded value to write.
+	Value string `json:"value"`
+	// Delay duration or notification timeout, in milliseconds.
+	Duration int `json:"duration"`
+	// Branch condition and the steps run when it holds or not.
+	If   *ProcedureCondition `json:"if"`
+	Then []ProcedureStep     `json:"then"`
+	Else []ProcedureStep     `json:"else"`
+}
+
+// ProcedureCondition tests the value returned by an earlier read or
+// wait_notification step. Values are hex encoded.
+type ProcedureCondition struct {
+	Step      string `json:"step"`
+	Equals    string `json:"equals"`
+	NotEquals string `json:"not_equals"`
+	Prefix    string `json:"prefix"`
 }
 
 type Service struct {
@@ -96,6 +328,8 @@ type Device struct {
 	ExonumID      string    `json:"exonum_id"`
 	DeviceGroupID string    `json:"device_group_id"`
 	OwnerKey      string    `json:"owner_key"`
+	MacKey        string    `json:"mac_key"`
+	IRK           string    `json:"irk"`
 }
 
 type DeviceResponseData struct {
@@ -106,4 +340,6 @@ type DeviceResponseData struct {
 type DeviceResponse struct {
 	BaseResponse
 	Data []DeviceResponseData `json:"data"`
+	// The page hasn't changed since it was last fetched.
+	NotModified bool `json:"-"`
 }
@@ -0,0 +1,159 @@
+package prot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/pkcs12"
+)
+
+// TLSConfig secures the connections to the masternodes. The zero value
+// trusts the system roots, with TLS 1.2 at least.
+type TLSConfig struct {
+	// PEM bundle of the root CAs trusted instead of the system ones, for
+	// masternodes with a certificate of a private CA.
+	CAFile string
+	// Pins of the SubjectPublicKeyInfo of a certificate in the chain, as the
+	// base64 of their SHA-256, optionally prefixed with "sha256/". Any pin
+	// matching is enough, so backup pins of keys not in use yet should be
+	// listed too, or the gateway is locked out when the key is rotated.
+	Pins []string
+	// Client certificate and key, PEM encoded, for masternodes requiring
+	// mutual TLS.
+	CertFile string
+	KeyFile  string
+	// Client certificate, its chain and key in a PKCS#12 bundle, instead of
+	// CertFile and KeyFile.
+	PKCS12File     string
+	PKCS12Password string
+	// Minimum TLS version, e.g. tls.VersionTLS13. TLS 1.2 by default.
+	MinVersion uint16
+}
+
+// PinError is returned when no certificate of a masternode matches the
+// pins. It isn't retried on other endpoints: the failed one is set aside
+// for the longest retry delay, as the connection may be intercepted.
+type PinError struct {
+	Subject string
+}
+
+func (e *PinError) Error() string {
+	return "certificate pinning failed for " + e.Subject
+}
+
+// IsPinError tells whether a request failed for certificate pinning.
+func IsPinError(err error) bool {
+	var pinErr *PinError
+	return errors.As(err, &pinErr)
+}
+
+func parsePins(pins []string) (map[string]bool, error) {
+	res := make(map[string]bool, len(pins))
+	for _, pin := range pins {
+		pin = strings.TrimPrefix(pin, "sha256/")
+		b, err := base64.StdEncoding.DecodeString(pin)
+		if err != nil || len(b) != sha256.Size {
+			return nil, errors.New("invalid pin " + pin)
+		}
+		res[string(b)] = true
+	}
+	return res, nil
+}
+
+// verifyPins returns the check of the pins against the certificates of the
+// verified chains.
+func verifyPins(pins map[string]bool) func([][]byte, [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		for _, chain := range verifiedChains {
+			for _, cert := range chain {
+				sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+				if pins[string(sum[:])] {
+					return nil
+				}
+			}
+		}
+		subject := "unknown peer"
+		if len(verifiedChains) > 0 && len(verifiedChains[0]) > 0 {
+			subject = verifiedChains[0][0].Subject.String()
+		}
+		return &PinError{Subject: subject}
+	}
+}
+
+func loadPKCS12(path, password string) (tls.Certificate, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	blocks, err := pkcs12.ToPEM(data, password)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	var certPEM, keyPEM bytes.Buffer
+	for _, b := range blocks {
+		// the bag attributes in the headers are of no use here
+		b.Headers = nil
+		if b.Type == "CERTIFICATE" {
+			pem.Encode(&certPEM, b)
+		} else {
+			pem.Encode(&keyPEM, b)
+		}
+	}
+	return tls.X509KeyPair(certPEM.Bytes(), keyPEM.Bytes())
+}
+
+func newTLSConfig(cfg TLSConfig) (*tls.Config, error) {
+	res := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.MinVersion != 0 {
+		res.MinVersion = cfg.MinVersion
+	}
+	if cfg.CAFile != "" {
+		data, err := ioutil.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		res.RootCAs = x509.NewCertPool()
+		if !res.RootCAs.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificate in " + cfg.CAFile)
+		}
+	}
+	if len(cfg.Pins) > 0 {
+		pins, err := parsePins(cfg.Pins)
+		if err != nil {
+			return nil, err
+		}
+		res.VerifyPeerCertificate = verifyPins(pins)
+	}
+	switch {
+	case cfg.PKCS12File != "":
+		cert, err := loadPKCS12(cfg.PKCS12File, cfg.PKCS12Password)
+		if err != nil {
+			return nil, err
+		}
+		res.Certificates = []tls.Certificate{cert}
+	case cfg.CertFile != "" || cfg.KeyFile != "":
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		res.Certificates = []tls.Certificate{cert}
+	}
+	return res, nil
+}
+
+// SetTLS configures the TLS connections to the masternodes.
+func (c *Client) SetTLS(cfg TLSConfig) error {
+	tlsConfig, err := newTLSConfig(cfg)
+	if err != nil {
+		return err
+	}
+	c.httpTransport().TLSClientConfig = tlsConfig
+	return nil
+}
@@ -0,0 +1,36 @@
+package prot_test
+
+import (
+	"clients/prot"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestIsPinError(t *testing.T) {
+	pinErr := &prot.PinError{Subject: "CN=masternode"}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "pin error", err: pinErr, want: true},
+		{name: "request", err: &url.Error{Op: "Post", URL: "https://masternode", Err: pinErr}, want: true},
+		{
+			name: "through a proxy",
+			err: &url.Error{Op: "Post", URL: "https://masternode",
+				Err: &net.OpError{Op: "proxyconnect", Net: "tcp", Err: pinErr}},
+			want: true,
+		},
+		{name: "other", err: &url.Error{Op: "Post", URL: "https://masternode", Err: errors.New("EOF")}},
+		{name: "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := prot.IsPinError(tt.err); got != tt.want {
+				t.Errorf("IsPinError(%v) = %t, want %t", tt.err, got, tt.want)
+			}
+		})
+	}
+}
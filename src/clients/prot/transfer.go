@@ -0,0 +1,131 @@
+package prot
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// EndpointStats count the traffic of an endpoint. Bytes are those of the
+// bodies as sent over the wire, so compressed when gzip is used.
+type EndpointStats struct {
+	Requests      int   `json:"requests"`
+	NotModified   int   `json:"not_modified"`
+	BytesSent     int64 `json:"bytes_sent"`
+	BytesReceived int64 `json:"bytes_received"`
+}
+
+// validator is what is needed for a conditional GET of a path, along with
+// the body returned last, which stands for the 304 responses.
+type validator struct {
+	etag         string
+	lastModified string
+	body         []byte
+}
+
+// transfer keeps the conditional GET validators and the traffic counters
+// of a client.
+type transfer struct {
+	mu         sync.Mutex
+	validators map[string]validator
+	stats      map[string]*EndpointStats
+}
+
+func newTransfer() *transfer {
+	return &transfer{
+		validators: make(map[string]validator),
+		stats:      make(map[string]*EndpointStats),
+	}
+}
+
+// stripQuery strips the query, so that all pages of a list count together.
+func stripQuery(path string) string {
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		return path[:i]
+	}
+	return path
+}
+
+func (t *transfer) count(path string, sent, received int, notModified bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.stats[stripQuery(path)]
+	if !ok {
+		s = &EndpointStats{}
+		t.stats[stripQuery(path)] = s
+	}
+	s.Requests++
+	s.BytesSent += int64(sent)
+	s.BytesReceived += int64(received)
+	if notModified {
+		s.NotModified++
+	}
+}
+
+// setConditional adds the validators of the last response of the path.
+func (t *transfer) setConditional(req *http.Request, path string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	v, ok := t.validators[path]
+	if !ok {
+		return
+	}
+	if v.etag != "" {
+		req.Header.Set("If-None-Match", v.etag)
+	} else if v.lastModified != "" {
+		req.Header.Set("If-Modified-Since", v.lastModified)
+	}
+}
+
+// remember stores the validators of a response, if it has any.
+func (t *transfer) remember(path string, resp *http.Response, body []byte) {
+	etag, lastModified := resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if etag == "" && lastModified == "" {
+		delete(t.validators, path)
+		return
+	}
+	t.validators[path] = validator{etag: etag, lastModified: lastModified, body: body}
+}
+
+// cached returns the body stored with the validators of the path.
+func (t *transfer) cached(path string) ([]byte, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	v, ok := t.validators[path]
+	return v.body, ok
+}
+
+func gzipBody(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := w.Write(body)
+	if err == nil {
+		err = w.Close()
+	}
+	return buf.Bytes(), err
+}
+
+func gunzipBody(body []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// Stats returns the traffic counters by endpoint path.
+func (c *Client) Stats() map[string]EndpointStats {
+	c.transfer.mu.Lock()
+	defer c.transfer.mu.Unlock()
+	res := make(map[string]EndpointStats, len(c.transfer.stats))
+	for path, s := range c.transfer.stats {
+		res[path] = *s
+	}
+	return res
+}
@@ -0,0 +1,284 @@
+package prot
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Transports to the masternodes.
+const (
+	// TransportDirect connects to the masternodes, the default.
+	TransportDirect = "direct"
+	// TransportHTTPProxy tunnels the connections through an HTTP proxy
+	// with CONNECT.
+	TransportHTTPProxy = "http_proxy"
+	// TransportSOCKS5 tunnels the connections through a SOCKS5 proxy.
+	TransportSOCKS5 = "socks5"
+	// TransportUnix sends every request over a Unix domain socket, e.g. to
+	// a local uplink daemon. The host of the endpoint URLs is ignored.
+	TransportUnix = "unix"
+)
+
+// TransportConfig selects how connections to the masternodes are made.
+type TransportConfig struct {
+	Kind string
+	// Address of the proxy as host:port, or path of the Unix socket.
+	Address string
+	// Credentials of the proxy, none when Username is empty.
+	Username string
+	Password string
+}
+
+// ProxyError is returned when the proxy didn't open the tunnel to the
+// masternode, which then counts as unreached.
+type ProxyError struct {
+	Proxy string
+	Addr  string
+	Err   error
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("proxy %s to %s: %s", e.Proxy, e.Addr, e.Err)
+}
+
+// dialFunc is the DialContext of an http.Transport.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func newDialer(cfg TransportConfig) (dialFunc, error) {
+	var d net.Dialer
+	switch cfg.Kind {
+	case "", TransportDirect:
+		return d.DialContext, nil
+	case TransportUnix:
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return d.DialContext(ctx, "unix", cfg.Address)
+		}, nil
+	case TransportHTTPProxy:
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := d.DialContext(ctx, "tcp", cfg.Address)
+			if err != nil {
+				return nil, err
+			}
+			var tunnel net.Conn
+			err = handshake(ctx, conn, func() error {
+				tunnel, err = httpConnect(conn, addr, cfg.Username, cfg.Password)
+				return err
+			})
+			if err != nil {
+				conn.Close()
+				return nil, &ProxyError{Proxy: cfg.Address, Addr: addr, Err: err}
+			}
+			return tunnel, nil
+		}, nil
+	case TransportSOCKS5:
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := d.DialContext(ctx, "tcp", cfg.Address)
+			if err != nil {
+				return nil, err
+			}
+			err = handshake(ctx, conn, func() error {
+				return socks5Connect(conn, addr, cfg.Username, cfg.Password)
+			})
+			if err != nil {
+				conn.Close()
+				return nil, &ProxyError{Proxy: cfg.Address, Addr: addr, Err: err}
+			}
+			return conn, nil
+		}, nil
+	}
+	return nil, errors.New("unknown transport " + cfg.Kind)
+}
+
+// proxyHandshakeTimeout bounds the handshake with the proxy when the dial
+// has no deadline, as for an http.Transport whose dials outlive requests.
+const proxyHandshakeTimeout = 30 * time.Second
+
+// handshake runs the handshake with the proxy on conn, bounded by the
+// deadline of ctx and given up once ctx is done. The requests going through
+// the tunnel have their own deadlines.
+func handshake(ctx context.Context, conn net.Conn, f func() error) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(proxyHandshakeTimeout)
+	}
+	conn.SetDeadline(deadline)
+	defer conn.SetDeadline(time.Time{})
+	stop := context.AfterFunc(ctx, func() {
+		// unblocks the handshake
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	err := f()
+	if !stop() {
+		return ctx.Err()
+	}
+	return err
+}
+
+// bufferedConn keeps what was read past the proxy response.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// httpConnect opens a tunnel to addr through an HTTP proxy.
+func httpConnect(conn net.Conn, addr, username, password string) (net.Conn, error) {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		req += "Proxy-Authorization: Basic " + credentials + "\r\n"
+	}
+	_, err := io.WriteString(conn, req+"\r\n")
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("proxy refused CONNECT to %s: %s", addr, resp.Status)
+	}
+	if r.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+	return conn, nil
+}
+
+// SOCKS5 values, see RFC 1928 and RFC 1929.
+const (
+	socks5Version       = 5
+	socks5NoAuth        = 0
+	socks5UserPass      = 2
+	socks5NoAcceptable  = 0xff
+	socks5CmdConnect    = 1
+	socks5IPv4          = 1
+	socks5Domain        = 3
+	socks5IPv6          = 4
+	socks5UserPassVer   = 1
+	socks5Succeeded     = 0
+	socks5MaxFieldBytes = 255
+)
+
+// socks5Connect opens a tunnel to addr through a SOCKS5 proxy. The host is
+// resolved by the proxy.
+func socks5Connect(conn net.Conn, addr, username, password string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return err
+	}
+	if len(host) > socks5MaxFieldBytes || len(username) > socks5MaxFieldBytes || len(password) > socks5MaxFieldBytes {
+		return errors.New("socks5: host or credentials too long")
+	}
+
+	methods := []byte{socks5NoAuth}
+	if username != "" {
+		methods = []byte{socks5UserPass}
+	}
+	_, err = conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...))
+	if err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return err
+	}
+	if reply[0] != socks5Version || reply[1] == socks5NoAcceptable || reply[1] != methods[0] {
+		return errors.New("socks5: no acceptable authentication method")
+	}
+	if reply[1] == socks5UserPass {
+		req := []byte{socks5UserPassVer, byte(len(username))}
+		req = append(req, username...)
+		req = append(req, byte(len(password)))
+		req = append(req, password...)
+		_, err = conn.Write(req)
+		if err != nil {
+			return err
+		}
+		_, err = io.ReadFull(conn, reply)
+		if err != nil {
+			return err
+		}
+		if reply[1] != socks5Succeeded {
+			return errors.New("socks5: authentication failed")
+		}
+	}
+
+	req := []byte{socks5Version, socks5CmdConnect, 0, socks5Domain, byte(len(host))}
+	req = append(req, host...)
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], uint16(port))
+	_, err = conn.Write(req)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, 4)
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		return err
+	}
+	if header[1] != socks5Succeeded {
+		return fmt.Errorf("socks5: connect to %s failed with code %d", addr, header[1])
+	}
+	// skip the bound address and port
+	var skip int
+	switch header[3] {
+	case socks5IPv4:
+		skip = net.IPv4len + 2
+	case socks5IPv6:
+		skip = net.IPv6len + 2
+	case socks5Domain:
+		n := make([]byte, 1)
+		_, err = io.ReadFull(conn, n)
+		if err != nil {
+			return err
+		}
+		skip = int(n[0]) + 2
+	default:
+		return errors.New("socks5: invalid address type in reply")
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip))
+	return err
+}
+
+// httpTransport returns the transport of the client, set up on first use.
+func (c *Client) httpTransport() *http.Transport {
+	transport, ok := c.client.Transport.(*http.Transport)
+	if !ok {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+		c.client.Transport = transport
+	}
+	return transport
+}
+
+// SetTransport sets how connections to the masternodes are made.
+func (c *Client) SetTransport(cfg TransportConfig) error {
+	dial, err := newDialer(cfg)
+	if err != nil {
+		return err
+	}
+	transport := c.httpTransport()
+	// the proxies of the environment would come on top of the transport
+	transport.Proxy = nil
+	transport.DialContext = dial
+	return nil
+}
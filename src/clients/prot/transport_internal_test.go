@@ -0,0 +1,68 @@
+package prot
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyHandshakeBounded(t *testing.T) {
+	tests := []struct {
+		name string
+		ctx  func() (context.Context, context.CancelFunc)
+	}{
+		{
+			name: "deadline",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 100*time.Millisecond)
+			},
+		},
+		{
+			name: "canceled",
+			ctx: func() (context.Context, context.CancelFunc) {
+				ctx, cancel := context.WithCancel(context.Background())
+				time.AfterFunc(100*time.Millisecond, cancel)
+				return ctx, cancel
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// a proxy which never answers the handshake
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("listen failed: %s", err)
+			}
+			defer listener.Close()
+			go func() {
+				conn, err := listener.Accept()
+				if err == nil {
+					ioutil.ReadAll(conn)
+					conn.Close()
+				}
+			}()
+
+			dial, err := newDialer(TransportConfig{Kind: TransportSOCKS5, Address: listener.Addr().String()})
+			if err != nil {
+				t.Fatalf("new dialer failed: %s", err)
+			}
+			ctx, cancel := tt.ctx()
+			defer cancel()
+			done := make(chan error, 1)
+			go func() {
+				_, err := dial(ctx, "tcp", "masternode:443")
+				done <- err
+			}()
+			select {
+			case err := <-done:
+				if _, ok := err.(*ProxyError); !ok {
+					t.Errorf("error %v, want a proxy error", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("handshake still waiting after the dial was over")
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package prot_test
+
+import (
+	"clients/prot"
+	"clients/prot/prottest"
+	"errors"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// syncThrough syncs a transaction with the masternode over the transport.
+func syncThrough(srv *prottest.Server, cfg prot.TransportConfig) error {
+	client := prot.NewClient(srv.URL, testAPIKey, testHash)
+	err := client.SetTransport(cfg)
+	if err != nil {
+		return err
+	}
+	err = client.Init(testLogger())
+	if err != nil {
+		return err
+	}
+	_, err = client.SyncTransaction(testTransactions(1))
+	return err
+}
+
+func TestProxyTransports(t *testing.T) {
+	tests := []struct {
+		name  string
+		proxy func() *prottest.Proxy
+		kind  string
+		// credentials the client sends
+		username string
+		password string
+		fail     string
+	}{
+		{
+			name:  "connect",
+			proxy: func() *prottest.Proxy { return prottest.NewConnectProxy("", "") },
+			kind:  prot.TransportHTTPProxy,
+		},
+		{
+			name:     "connect with basic auth",
+			proxy:    func() *prottest.Proxy { return prottest.NewConnectProxy("user", "secret") },
+			kind:     prot.TransportHTTPProxy,
+			username: "user",
+			password: "secret",
+		},
+		{
+			name:     "connect with wrong credentials",
+			proxy:    func() *prottest.Proxy { return prottest.NewConnectProxy("user", "secret") },
+			kind:     prot.TransportHTTPProxy,
+			username: "user",
+			password: "wrong",
+			fail:     "407",
+		},
+		{
+			name:  "connect without credentials",
+			proxy: func() *prottest.Proxy { return prottest.NewConnectProxy("user", "secret") },
+			kind:  prot.TransportHTTPProxy,
+			fail:  "407",
+		},
+		{
+			name:  "socks5",
+			proxy: func() *prottest.Proxy { return prottest.NewSOCKS5Proxy("", "") },
+			kind:  prot.TransportSOCKS5,
+		},
+		{
+			name:     "socks5 with user/password",
+			proxy:    func() *prottest.Proxy { return prottest.NewSOCKS5Proxy("user", "secret") },
+			kind:     prot.TransportSOCKS5,
+			username: "user",
+			password: "secret",
+		},
+		{
+			name:     "socks5 with wrong credentials",
+			proxy:    func() *prottest.Proxy { return prottest.NewSOCKS5Proxy("user", "secret") },
+			kind:     prot.TransportSOCKS5,
+			username: "user",
+			password: "wrong",
+			fail:     "authentication failed",
+		},
+		{
+			name:  "socks5 without credentials",
+			proxy: func() *prottest.Proxy { return prottest.NewSOCKS5Proxy("user", "secret") },
+			kind:  prot.TransportSOCKS5,
+			fail:  "no acceptable authentication method",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := prottest.NewServer(testAPIKey)
+			defer srv.Close()
+			proxy := tt.proxy()
+			defer proxy.Close()
+
+			err := syncThrough(srv, prot.TransportConfig{
+				Kind:     tt.kind,
+				Address:  proxy.Addr,
+				Username: tt.username,
+				Password: tt.password,
+			})
+			if tt.fail != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.fail) {
+					t.Errorf("error %v, want one with %q", err, tt.fail)
+				}
+				var proxyErr *prot.ProxyError
+				if !errors.As(err, &proxyErr) {
+					t.Errorf("error %v, want a proxy error", err)
+				}
+				if proxy.Failures() == 0 {
+					t.Errorf("proxy counted no failure")
+				}
+				if n := len(srv.Requests()); n != 0 {
+					t.Errorf("server received %d requests through a refusing proxy", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("sync failed: %s", err)
+			}
+			u, _ := url.Parse(srv.URL)
+			targets := proxy.Targets()
+			if len(targets) == 0 || targets[0] != u.Host {
+				t.Errorf("proxy tunneled to %v, want %s", targets, u.Host)
+			}
+			if n := len(srv.Transactions()); n != 1 {
+				t.Errorf("server stored %d transactions, want 1", n)
+			}
+		})
+	}
+}
+
+func TestProxyFailover(t *testing.T) {
+	tests := []struct {
+		name  string
+		proxy func() *prottest.Proxy
+		kind  string
+	}{
+		{name: "connect", proxy: func() *prottest.Proxy { return prottest.NewConnectProxy("", "") }, kind: prot.TransportHTTPProxy},
+		{name: "socks5", proxy: func() *prottest.Proxy { return prottest.NewSOCKS5Proxy("", "") }, kind: prot.TransportSOCKS5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			down := prottest.NewServer(testAPIKey)
+			downURL := down.URL
+			down.Close()
+			srv := prottest.NewServer(testAPIKey)
+			defer srv.Close()
+			proxy := tt.proxy()
+			defer proxy.Close()
+
+			// the sync goes to the second masternode first, which the proxy
+			// can't reach
+			client := prot.NewClient(srv.URL, testAPIKey, testHash)
+			client.AddEndpoints(downURL)
+			client.SetSelection(prot.SelectRoundRobin, 0)
+			err := client.SetTransport(prot.TransportConfig{Kind: tt.kind, Address: proxy.Addr})
+			if err != nil {
+				t.Fatalf("set transport failed: %s", err)
+			}
+			err = client.Init(testLogger())
+			if err != nil {
+				t.Fatalf("init failed: %s", err)
+			}
+			res, err := client.SyncTransaction(testTransactions(1))
+			if err != nil {
+				t.Fatalf("sync failed: %s", err)
+			}
+			if res.Endpoint != srv.URL {
+				t.Errorf("synced with %q, want %q", res.Endpoint, srv.URL)
+			}
+			if proxy.Failures() == 0 {
+				t.Errorf("proxy counted no failure")
+			}
+			health := client.Endpoints()
+			if !health[0].Healthy || health[1].Healthy {
+				t.Errorf("endpoints %+v, want the first healthy only", health)
+			}
+		})
+	}
+}
+
+func TestUnixTransport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "masternode.sock")
+	srv := prottest.NewUnixServer(testAPIKey, path)
+	defer srv.Close()
+
+	err := syncThrough(srv, prot.TransportConfig{Kind: prot.TransportUnix, Address: path})
+	if err != nil {
+		t.Fatalf("sync failed: %s", err)
+	}
+	if n := len(srv.Transactions()); n != 1 {
+		t.Errorf("server stored %d transactions, want 1", n)
+	}
+}
+
+func TestUnknownTransport(t *testing.T) {
+	client := prot.NewClient("http://127.0.0.1", testAPIKey, testHash)
+	err := client.SetTransport(prot.TransportConfig{Kind: "carrier_pigeon"})
+	if err == nil || !strings.Contains(err.Error(), "unknown transport carrier_pigeon") {
+		t.Errorf("error %v, want an unknown transport", err)
+	}
+}
@@ -39,48 +39,194 @@ const (
 		"sended INTEGER," +
 		"payload TEXT" +
 		")"
+	createDeviceScheduleTable = "CREATE TABLE IF NOT EXISTS device_schedule(" +
+		"device_hash  TEXT PRIMARY KEY," +
+		"next_attempt INTEGER," +
+		"failures     INTEGER," +
+		"updated_at   INTEGER" +
+		")"
+	createPresenceTable = "CREATE TABLE IF NOT EXISTS presence(" +
+		"device_hash  TEXT PRIMARY KEY," +
+		"last_seen    INTEGER," +
+		"rssi         REAL," +
+		"adv_count    INTEGER," +
+		"window_start INTEGER," +
+		"window_count INTEGER," +
+		"last_session INTEGER" +
+		")"
+	createGattCacheTable = "CREATE TABLE IF NOT EXISTS gatt_cache(" +
+		"device_hash TEXT PRIMARY KEY," +
+		"firmware    TEXT," +
+		"attributes  TEXT," +
+		"updated_at  INTEGER" +
+		")"
+	createDiscoveredTable = "CREATE TABLE IF NOT EXISTS discovered(" +
+		"address    TEXT PRIMARY KEY," +
+		"name       TEXT," +
+		"rssi       INTEGER," +
+		"services   TEXT," +
+		"company_id INTEGER," +
+		"adv_count  INTEGER," +
+		"first_seen INTEGER," +
+		"last_seen  INTEGER" +
+		")"
+	createSettingTable = "CREATE TABLE IF NOT EXISTS setting(" +
+		"key   TEXT PRIMARY KEY," +
+		"value TEXT" +
+		")"
 
 	transactionInsertQuery = "INSERT INTO tr " +
 		"(hash, device_hash, timestamp, uplink, sended, payload) " +
 		"VALUES (?, ?, ?, ?, ?, ?)"
 	deviceInsertQuery = "INSERT INTO device " +
-		"(hash, manufacturer, created_at, updated_at, exonum_id, device_group_id, owner_key) " +
-		"VALUES ($1, $2, $3, $4, $5, $6, $7)" +
+		"(hash, manufacturer, created_at, updated_at, exonum_id, device_group_id, owner_key, mac_key, irk) " +
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)" +
 		"ON CONFLICT(hash) DO " +
 		"UPDATE SET " +
 		"manufacturer = $2, created_at = $3, updated_at = $4, exonum_id = $5, " +
-		"device_group_id = $6, owner_key = $7 " +
+		"device_group_id = $6, owner_key = $7, mac_key = $8, irk = $9, removed_at = 0 " +
 		"WHERE hash = $1"
 	deviceGroupInsertQuery = "INSERT INTO device_group " +
 		"(" +
 		"exonum_id, name, group_type, uplink_lifetime, downlink_lifetime, " +
-		"services, created_at, updated_at,  owner_key " +
+		"services, created_at, updated_at,  owner_key, settings " +
 		") " +
-		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)" +
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)" +
 		"ON CONFLICT(exonum_id) DO " +
 		"UPDATE SET " +
 		"name = $2, group_type = $3, uplink_lifetime = $4, downlink_lifetime = $5, " +
-		"services = $6, created_at = $7, updated_at = $8, owner_key = $9 " +
+		"services = $6, created_at = $7, updated_at = $8, owner_key = $9, settings = $10, removed_at = 0 " +
 		"WHERE exonum_id = $1"
 	deviceGetQuery = "SELECT " +
-		"id, hash, manufacturer, created_at, updated_at, exonum_id, device_group_id, owner_key " +
+		"id, hash, manufacturer, created_at, updated_at, exonum_id, device_group_id, owner_key, mac_key, " +
+		"manufacturer_name, model_number, serial_number, hardware_revision, firmware_revision, " +
+		"software_revision, battery_level, first_session_at, last_session_at, info_updated_at, info_reported_at, " +
+		"irk, removed_at " +
+		"FROM device WHERE removed_at = 0"
+	deviceGetWithRemovedQuery = "SELECT " +
+		"id, hash, manufacturer, created_at, updated_at, exonum_id, device_group_id, owner_key, mac_key, " +
+		"manufacturer_name, model_number, serial_number, hardware_revision, firmware_revision, " +
+		"software_revision, battery_level, first_session_at, last_session_at, info_updated_at, info_reported_at, " +
+		"irk, removed_at " +
 		"FROM device"
 	deviceGetByHashQuery = "SELECT " +
-		"id, hash, manufacturer, created_at, updated_at, exonum_id, device_group_id, owner_key " +
+		"id, hash, manufacturer, created_at, updated_at, exonum_id, device_group_id, owner_key, mac_key, " +
+		"manufacturer_name, model_number, serial_number, hardware_revision, firmware_revision, " +
+		"software_revision, battery_level, first_session_at, last_session_at, info_updated_at, info_reported_at, " +
+		"irk, removed_at " +
 		"FROM device WHERE LOWER(hash) = LOWER($1)"
 	deviceGroupGetQuery = "SELECT " +
 		"id, exonum_id, name, group_type, uplink_lifetime, downlink_lifetime, " +
-		"services, created_at, updated_at,  owner_key " +
+		"services, created_at, updated_at,  owner_key, settings, removed_at " +
+		"FROM device_group WHERE removed_at = 0"
+	deviceGroupGetWithRemovedQuery = "SELECT " +
+		"id, exonum_id, name, group_type, uplink_lifetime, downlink_lifetime, " +
+		"services, created_at, updated_at,  owner_key, settings, removed_at " +
 		"FROM device_group"
 	deviceGroupGetByIdQuery = "SELECT " +
 		"id, exonum_id, name, group_type, uplink_lifetime, downlink_lifetime, " +
-		"services, created_at, updated_at,  owner_key " +
+		"services, created_at, updated_at,  owner_key, settings, removed_at " +
 		"FROM device_group WHERE LOWER(exonum_id) = LOWER($1)"
+	deviceInfoUnreportedQuery = "SELECT " +
+		"id, hash, manufacturer, created_at, updated_at, exonum_id, device_group_id, owner_key, mac_key, " +
+		"manufacturer_name, model_number, serial_number, hardware_revision, firmware_revision, " +
+		"software_revision, battery_level, first_session_at, last_session_at, info_updated_at, info_reported_at, " +
+		"irk, removed_at " +
+		"FROM device WHERE info_updated_at > info_reported_at"
+	deviceInfoUpdateQuery = "UPDATE device SET " +
+		"manufacturer_name = $1, model_number = $2, serial_number = $3, hardware_revision = $4, " +
+		"firmware_revision = $5, software_revision = $6, info_updated_at = $7 " +
+		"WHERE LOWER(hash) = LOWER($8)"
+	deviceSessionUpdateQuery = "UPDATE device SET " +
+		"first_session_at = CASE WHEN first_session_at = 0 THEN $1 ELSE first_session_at END, " +
+		"last_session_at = $1, " +
+		"battery_level = CASE WHEN $2 >= 0 THEN $2 ELSE battery_level END " +
+		"WHERE LOWER(hash) = LOWER($3)"
+	deviceRemoveQuery = "UPDATE device SET " +
+		"removed_at = $1 " +
+		"WHERE LOWER(hash) = LOWER($2) AND removed_at = 0"
+	deviceRemovedGetQuery  = "SELECT hash FROM device WHERE removed_at > 0 AND removed_at < $1"
+	deviceGroupRemoveQuery = "UPDATE device_group SET " +
+		"removed_at = $1 " +
+		"WHERE LOWER(exonum_id) = LOWER($2) AND removed_at = 0"
+	deviceGroupPurgeQuery   = "DELETE FROM device_group WHERE removed_at > 0 AND removed_at < $1"
+	deviceInfoReportedQuery = "UPDATE device SET " +
+		"info_reported_at = $1 " +
+		"WHERE LOWER(hash) = LOWER($2)"
 	transactionGetQuery = "SELECT " +
 		"id, hash, device_hash, timestamp, uplink, sended, payload " +
-		"FROM tr WHERE sended = 0"
+		"FROM tr WHERE sended = 0 ORDER BY timestamp, id"
+	scheduleGetQuery = "SELECT " +
+		"device_hash, next_attempt, failures, updated_at " +
+		"FROM device_schedule"
+	scheduleUpsertQuery = "INSERT INTO device_schedule " +
+		"(device_hash, next_attempt, failures, updated_at) " +
+		"VALUES ($1, $2, $3, $4) " +
+		"ON CONFLICT(device_hash) DO " +
+		"UPDATE SET " +
+		"next_attempt = $2, failures = $3, updated_at = $4 " +
+		"WHERE device_hash = $1"
+	presenceGetQuery = "SELECT " +
+		"device_hash, last_seen, rssi, adv_count, window_start, window_count, last_session " +
+		"FROM presence"
+	presenceUpsertQuery = "INSERT INTO presence " +
+		"(device_hash, last_seen, rssi, adv_count, window_start, window_count, last_session) " +
+		"VALUES ($1, $2, $3, $4, $5, $6, $7) " +
+		"ON CONFLICT(device_hash) DO " +
+		"UPDATE SET " +
+		"last_seen = $2, rssi = $3, adv_count = $4, window_start = $5, " +
+		"window_count = $6, last_session = $7 " +
+		"WHERE device_hash = $1"
+	gattCacheGetQuery = "SELECT " +
+		"device_hash, firmware, attributes, updated_at " +
+		"FROM gatt_cache WHERE LOWER(device_hash) = LOWER($1)"
+	gattCacheUpsertQuery = "INSERT INTO gatt_cache " +
+		"(device_hash, firmware, attributes, updated_at) " +
+		"VALUES ($1, $2, $3, $4) " +
+		"ON CONFLICT(device_hash) DO " +
+		"UPDATE SET " +
+		"firmware = $2, attributes = $3, updated_at = $4 " +
+		"WHERE device_hash = $1"
+	gattCacheDeleteQuery = "DELETE FROM gatt_cache WHERE LOWER(device_hash) = LOWER($1)"
+	discoveredGetQuery   = "SELECT " +
+		"address, name, rssi, services, company_id, adv_count, first_seen, last_seen " +
+		"FROM discovered ORDER BY last_seen DESC"
+	discoveredUpsertQuery = "INSERT INTO discovered " +
+		"(address, name, rssi, services, company_id, adv_count, first_seen, last_seen) " +
+		"VALUES ($1, $2, $3, $4, $5, $6, $7, $8) " +
+		"ON CONFLICT(address) DO " +
+		"UPDATE SET " +
+		"name = $2, rssi = $3, services = $4, company_id = $5, adv_count = $6, " +
+		"first_seen = $7, last_seen = $8 " +
+		"WHERE address = $1"
+	discoveredDeleteQuery = "DELETE FROM discovered WHERE last_seen < $1"
+	settingGetQuery       = "SELECT value FROM setting WHERE key = $1"
+	settingSetQuery       = "INSERT INTO setting (key, value) VALUES ($1, $2) " +
+		"ON CONFLICT(key) DO UPDATE SET value = $2 WHERE key = $1"
 )
 
+// migrations alter the tables created above. They are applied in order and
+// the number of applied ones is kept in the database user_version.
+var migrations = []string{
+	"ALTER TABLE device_group ADD COLUMN settings TEXT NOT NULL DEFAULT '{}'",
+	"ALTER TABLE device ADD COLUMN mac_key TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE device ADD COLUMN manufacturer_name TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE device ADD COLUMN model_number TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE device ADD COLUMN serial_number TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE device ADD COLUMN hardware_revision TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE device ADD COLUMN firmware_revision TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE device ADD COLUMN software_revision TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE device ADD COLUMN battery_level INTEGER NOT NULL DEFAULT -1",
+	"ALTER TABLE device ADD COLUMN first_session_at INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE device ADD COLUMN last_session_at INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE device ADD COLUMN info_updated_at INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE device ADD COLUMN info_reported_at INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE device ADD COLUMN irk TEXT NOT NULL DEFAULT ''",
+	"ALTER TABLE device ADD COLUMN removed_at INTEGER NOT NULL DEFAULT 0",
+	"ALTER TABLE device_group ADD COLUMN removed_at INTEGER NOT NULL DEFAULT 0",
+	"UPDATE tr SET timestamp = timestamp * 1000",
+}
+
 
 
 type DBAdapter struct {
@@ -95,15 +241,22 @@ func NewDBAdapter(path string) (*DBAdapter, error) {
 	if err != nil {
 		return nil, err
 	}
-	_, err = database.Exec(createDeviceTable)
-	if err != nil {
-		return nil, err
-	}
-	_, err = database.Exec(createDeviceGroupTable)
-	if err != nil {
-		return nil, err
+	for _, query := range []string{
+		createDeviceTable,
+		createDeviceGroupTable,
+		createTransactionTable,
+		createDeviceScheduleTable,
+		createPresenceTable,
+		createGattCacheTable,
+		createDiscoveredTable,
+		createSettingTable,
+	} {
+		_, err = database.Exec(query)
+		if err != nil {
+			return nil, err
+		}
 	}
-	_, err = database.Exec(createTransactionTable)
+	err = migrate(database)
 	if err != nil {
 		return nil, err
 	}
@@ -127,6 +280,33 @@ func NewDBAdapter(path string) (*DBAdapter, error) {
 	}, nil
 }
 
+func migrate(database *sql.DB) error {
+	var version int
+	err := database.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+	for ; version < len(migrations); version++ {
+		tx, err := database.Begin()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec(migrations[version])
+		if err == nil {
+			_, err = tx.Exec("PRAGMA user_version = " + strconv.Itoa(version+1))
+		}
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (db *DBAdapter) InsertTransaction(v Transaction) error {
 	_, err := db.transactionInsertStmt.Exec(
 		v.Hash,
@@ -164,7 +344,9 @@ func (db *DBAdapter) InsertDevices(devices []Device) error {
 			device.UpdatedAt,
 			device.ExonumID,
 			device.DeviceGroupID,
-			device.OwnerKey)
+			device.OwnerKey,
+			device.MacKey,
+			device.IRK)
 		if err != nil {
 			return err
 		}
@@ -183,7 +365,8 @@ func (db *DBAdapter) InsertDeviceGroups(deviceGroups []DeviceGroup) error {
 			deviceGroup.Services,
 			deviceGroup.CreatedAt,
 			deviceGroup.UpdatedAt,
-			deviceGroup.OwnerKey)
+			deviceGroup.OwnerKey,
+			deviceGroup.Settings)
 		if err != nil {
 			return err
 		}
@@ -205,24 +388,55 @@ func (db *DBAdapter) SetSendedTransaction(ids []int) error {
 	return nil
 }
 
+func scanDevice(rows *sql.Rows) (Device, error) {
+	var d Device
+	err := rows.Scan(
+		&d.ID,
+		&d.Hash,
+		&d.Manufacturer,
+		&d.CreatedAt,
+		&d.UpdatedAt,
+		&d.ExonumID,
+		&d.DeviceGroupID,
+		&d.OwnerKey,
+		&d.MacKey,
+		&d.ManufacturerName,
+		&d.ModelNumber,
+		&d.SerialNumber,
+		&d.HardwareRevision,
+		&d.FirmwareRevision,
+		&d.SoftwareRevision,
+		&d.BatteryLevel,
+		&d.FirstSessionAt,
+		&d.LastSessionAt,
+		&d.InfoUpdatedAt,
+		&d.InfoReportedAt,
+		&d.IRK,
+		&d.RemovedAt)
+	return d, err
+}
+
+// GetDevices returns the whitelisted devices, without the ones removed on
+// the masternode.
 func (db *DBAdapter) GetDevices() ([]Device, error) {
-	rows, err := db.db.Query(deviceGetQuery)
+	return db.getDevices(deviceGetQuery)
+}
+
+// GetDevicesWithRemoved returns all devices, including the tombstones of
+// devices removed on the masternode.
+func (db *DBAdapter) GetDevicesWithRemoved() ([]Device, error) {
+	return db.getDevices(deviceGetWithRemovedQuery)
+}
+
+func (db *DBAdapter) getDevices(query string) ([]Device, error) {
+	rows, err := db.db.Query(query)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	var devices []Device
 	for rows.Next() {
-		var d Device
-		err = rows.Scan(
-			&d.ID,
-			&d.Hash,
-			&d.Manufacturer,
-			&d.CreatedAt,
-			&d.UpdatedAt,
-			&d.ExonumID,
-			&d.DeviceGroupID,
-			&d.OwnerKey)
+		d, err := scanDevice(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -238,16 +452,7 @@ func (db *DBAdapter) GetDeviceByHash(hash string) (*Device, error) {
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var d Device
-		err = rows.Scan(
-			&d.ID,
-			&d.Hash,
-			&d.Manufacturer,
-			&d.CreatedAt,
-			&d.UpdatedAt,
-			&d.ExonumID,
-			&d.DeviceGroupID,
-			&d.OwnerKey)
+		d, err := scanDevice(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -256,26 +461,45 @@ func (db *DBAdapter) GetDeviceByHash(hash string) (*Device, error) {
 	return nil, nil
 }
 
+func scanDeviceGroup(rows *sql.Rows) (DeviceGroup, error) {
+	var d DeviceGroup
+	err := rows.Scan(
+		&d.ID,
+		&d.ExonumID,
+		&d.Name,
+		&d.GroupType,
+		&d.UplinkLifetime,
+		&d.DownlinkLifetime,
+		&d.Services,
+		&d.CreatedAt,
+		&d.UpdatedAt,
+		&d.OwnerKey,
+		&d.Settings,
+		&d.RemovedAt)
+	return d, err
+}
+
+// GetDeviceGroups returns the device groups, without the ones removed on the
+// masternode.
 func (db *DBAdapter) GetDeviceGroups() ([]DeviceGroup, error) {
-	rows, err := db.db.Query(deviceGroupGetQuery)
+	return db.getDeviceGroups(deviceGroupGetQuery)
+}
+
+// GetDeviceGroupsWithRemoved returns all device groups, including the
+// tombstones of groups removed on the masternode.
+func (db *DBAdapter) GetDeviceGroupsWithRemoved() ([]DeviceGroup, error) {
+	return db.getDeviceGroups(deviceGroupGetWithRemovedQuery)
+}
+
+func (db *DBAdapter) getDeviceGroups(query string) ([]DeviceGroup, error) {
+	rows, err := db.db.Query(query)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 	var deviceGroups []DeviceGroup
 	for rows.Next() {
-		var d DeviceGroup
-		err = rows.Scan(
-			&d.ID,
-			&d.ExonumID,
-			&d.Name,
-			&d.GroupType,
-			&d.UplinkLifetime,
-			&d.DownlinkLifetime,
-			&d.Services,
-			&d.CreatedAt,
-			&d.UpdatedAt,
-			&d.OwnerKey)
+		d, err := scanDeviceGroup(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -291,18 +515,7 @@ func (db *DBAdapter) GetDeviceGroupByID(id string) (*DeviceGroup, error) {
 	}
 	defer rows.Close()
 	for rows.Next() {
-		var d DeviceGroup
-		err = rows.Scan(
-			&d.ID,
-			&d.ExonumID,
-			&d.Name,
-			&d.GroupType,
-			&d.UplinkLifetime,
-			&d.DownlinkLifetime,
-			&d.Services,
-			&d.CreatedAt,
-			&d.UpdatedAt,
-			&d.OwnerKey)
+		d, err := scanDeviceGroup(rows)
 		if err != nil {
 			return nil, err
 		}
@@ -326,3 +539,277 @@ func (db *DBAdapter) GetUnsendTransaction() ([]Transaction, error) {
 	return transactions, nil
 
 }
+
+func (db *DBAdapter) GetSchedules() ([]Schedule, error) {
+	rows, err := db.db.Query(scheduleGetQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var schedules []Schedule
+	for rows.Next() {
+		var s Schedule
+		err = rows.Scan(&s.DeviceHash, &s.NextAttempt, &s.Failures, &s.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		schedules = append(schedules, s)
+	}
+	return schedules, nil
+}
+
+func (db *DBAdapter) UpsertSchedule(s Schedule) error {
+	_, err := db.db.Exec(scheduleUpsertQuery, s.DeviceHash, s.NextAttempt, s.Failures, s.UpdatedAt)
+	return err
+}
+
+func (db *DBAdapter) GetPresences() ([]Presence, error) {
+	rows, err := db.db.Query(presenceGetQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var presences []Presence
+	for rows.Next() {
+		var p Presence
+		err = rows.Scan(
+			&p.DeviceHash,
+			&p.LastSeen,
+			&p.RSSI,
+			&p.AdvCount,
+			&p.WindowStart,
+			&p.WindowCount,
+			&p.LastSession)
+		if err != nil {
+			return nil, err
+		}
+		presences = append(presences, p)
+	}
+	return presences, nil
+}
+
+func (db *DBAdapter) UpsertPresences(presences []Presence) error {
+	for _, p := range presences {
+		_, err := db.db.Exec(presenceUpsertQuery,
+			p.DeviceHash,
+			p.LastSeen,
+			p.RSSI,
+			p.AdvCount,
+			p.WindowStart,
+			p.WindowCount,
+			p.LastSession)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DBAdapter) GetGattCache(hash string) (*GattCache, error) {
+	rows, err := db.db.Query(gattCacheGetQuery, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c GattCache
+		err = rows.Scan(&c.DeviceHash, &c.Firmware, &c.Attributes, &c.UpdatedAt)
+		if err != nil {
+			return nil, err
+		}
+		return &c, nil
+	}
+	return nil, nil
+}
+
+func (db *DBAdapter) UpsertGattCache(c GattCache) error {
+	_, err := db.db.Exec(gattCacheUpsertQuery, c.DeviceHash, c.Firmware, c.Attributes, c.UpdatedAt)
+	return err
+}
+
+func (db *DBAdapter) DeleteGattCache(hash string) error {
+	_, err := db.db.Exec(gattCacheDeleteQuery, hash)
+	return err
+}
+
+// GetUnreportedDeviceInfo returns the devices whose information changed
+// since it was last reported to the masternode.
+func (db *DBAdapter) GetUnreportedDeviceInfo() ([]Device, error) {
+	rows, err := db.db.Query(deviceInfoUnreportedQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var devices []Device
+	for rows.Next() {
+		d, err := scanDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
+// UpdateDeviceInfo stores the Device Information Service values of the device.
+func (db *DBAdapter) UpdateDeviceInfo(d Device) error {
+	_, err := db.db.Exec(deviceInfoUpdateQuery,
+		d.ManufacturerName,
+		d.ModelNumber,
+		d.SerialNumber,
+		d.HardwareRevision,
+		d.FirmwareRevision,
+		d.SoftwareRevision,
+		d.InfoUpdatedAt,
+		d.Hash)
+	return err
+}
+
+// UpdateDeviceSession records a session with the device. A negative battery
+// level keeps the stored one.
+func (db *DBAdapter) UpdateDeviceSession(hash string, at, batteryLevel int) error {
+	_, err := db.db.Exec(deviceSessionUpdateQuery, at, batteryLevel, hash)
+	return err
+}
+
+// SetDeviceInfoReported marks the device information updated at the given
+// time as reported.
+func (db *DBAdapter) SetDeviceInfoReported(hash string, updatedAt int) error {
+	_, err := db.db.Exec(deviceInfoReportedQuery, updatedAt, hash)
+	return err
+}
+
+func (db *DBAdapter) GetDiscovered() ([]Discovered, error) {
+	rows, err := db.db.Query(discoveredGetQuery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var discovered []Discovered
+	for rows.Next() {
+		var d Discovered
+		err = rows.Scan(
+			&d.Address,
+			&d.Name,
+			&d.RSSI,
+			&d.Services,
+			&d.CompanyID,
+			&d.AdvCount,
+			&d.FirstSeen,
+			&d.LastSeen)
+		if err != nil {
+			return nil, err
+		}
+		discovered = append(discovered, d)
+	}
+	return discovered, nil
+}
+
+func (db *DBAdapter) UpsertDiscovered(discovered []Discovered) error {
+	for _, d := range discovered {
+		_, err := db.db.Exec(discoveredUpsertQuery,
+			d.Address,
+			d.Name,
+			d.RSSI,
+			d.Services,
+			d.CompanyID,
+			d.AdvCount,
+			d.FirstSeen,
+			d.LastSeen)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DeleteDiscoveredBefore drops the discovered devices not seen since the
+// given time.
+func (db *DBAdapter) DeleteDiscoveredBefore(lastSeen int) error {
+	_, err := db.db.Exec(discoveredDeleteQuery, lastSeen)
+	return err
+}
+
+// RemoveDevice tombstones a device removed on the masternode. The device is
+// no longer whitelisted, its data is kept until PurgeRemovedDevices.
+func (db *DBAdapter) RemoveDevice(hash string, at int) error {
+	_, err := db.db.Exec(deviceRemoveQuery, at, hash)
+	return err
+}
+
+// PurgeRemovedDevices deletes the devices removed before the given time,
+// along with their schedules, presence and GATT caches.
+func (db *DBAdapter) PurgeRemovedDevices(before int) ([]string, error) {
+	rows, err := db.db.Query(deviceRemovedGetQuery, before)
+	if err != nil {
+		return nil, err
+	}
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		err = rows.Scan(&hash)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+
+	tx, err := db.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	for _, hash := range hashes {
+		for _, query := range []string{
+			"DELETE FROM device WHERE hash = $1",
+			"DELETE FROM device_schedule WHERE device_hash = $1",
+			"DELETE FROM presence WHERE device_hash = $1",
+			"DELETE FROM gatt_cache WHERE device_hash = $1",
+		} {
+			_, err = tx.Exec(query, hash)
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+	}
+	return hashes, tx.Commit()
+}
+
+// RemoveDeviceGroup tombstones a device group removed on the masternode,
+// until PurgeRemovedDeviceGroups.
+func (db *DBAdapter) RemoveDeviceGroup(id string, at int) error {
+	_, err := db.db.Exec(deviceGroupRemoveQuery, at, id)
+	return err
+}
+
+// PurgeRemovedDeviceGroups deletes the device groups removed before the
+// given time and returns how many there were.
+func (db *DBAdapter) PurgeRemovedDeviceGroups(before int) (int, error) {
+	res, err := db.db.Exec(deviceGroupPurgeQuery, before)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// GetSetting returns the value stored under the key by the gateway itself,
+// false when there is none.
+func (db *DBAdapter) GetSetting(key string) (string, bool, error) {
+	var value string
+	err := db.db.QueryRow(settingGetQuery, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+func (db *DBAdapter) SetSetting(key, value string) error {
+	_, err := db.db.Exec(settingSetQuery, key, value)
+	return err
+}
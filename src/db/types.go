@@ -1,10 +1,12 @@
 package db
 
+import "time"
+
 type Transaction struct {
 	ID         int    `json:"id"`
 	Hash       string `json:"hash"`
 	DeviceHash string `json:"device_hash"`
-	Timestamp  int    `json:"timestamp"`
+	Timestamp  int64  `json:"timestamp"` // unix milliseconds, see Timestamp
 	Uplink     int    `json:"uplink"`
 	Sended     int    `json:"sended"`
 	Payload    string `json:"payload"`
@@ -19,6 +21,24 @@ type Device struct {
 	ExonumID      string `json:"exonum_id"`
 	DeviceGroupID string `json:"device_group_id"`
 	OwnerKey      string `json:"owner_key"`
+	MacKey        string `json:"mac_key"`
+	IRK           string `json:"irk"`
+	// Set when the device was removed on the masternode.
+	RemovedAt int `json:"removed_at"`
+
+	// Learned by the gateway from the Device Information and Battery
+	// services, not sent by the masternode.
+	ManufacturerName string `json:"manufacturer_name"`
+	ModelNumber      string `json:"model_number"`
+	SerialNumber     string `json:"serial_number"`
+	HardwareRevision string `json:"hardware_revision"`
+	FirmwareRevision string `json:"firmware_revision"`
+	SoftwareRevision string `json:"software_revision"`
+	BatteryLevel     int    `json:"battery_level"`
+	FirstSessionAt   int    `json:"first_session_at"`
+	LastSessionAt    int    `json:"last_session_at"`
+	InfoUpdatedAt    int    `json:"info_updated_at"`
+	InfoReportedAt   int    `json:"info_reported_at"`
 }
 
 type DeviceGroup struct {
@@ -32,4 +52,57 @@ type DeviceGroup struct {
 	UpdatedAt        int    `json:"updated_at"`
 	ExonumID         string `json:"exonum_id"`
 	OwnerKey         string `json:"owner_key"`
+	Settings         string `json:"settings"`
+	// Set when the device group was removed on the masternode.
+	RemovedAt int `json:"removed_at"`
+}
+
+type Schedule struct {
+	DeviceHash  string `json:"device_hash"`
+	NextAttempt int    `json:"next_attempt"`
+	Failures    int    `json:"failures"`
+	UpdatedAt   int    `json:"updated_at"`
+}
+
+type Presence struct {
+	DeviceHash  string  `json:"device_hash"`
+	LastSeen    int     `json:"last_seen"`
+	RSSI        float64 `json:"rssi"`
+	AdvCount    int     `json:"adv_count"`
+	WindowStart int     `json:"window_start"`
+	WindowCount int     `json:"window_count"`
+	LastSession int     `json:"last_session"`
+}
+
+type GattCache struct {
+	DeviceHash string `json:"device_hash"`
+	Firmware   string `json:"firmware"`
+	Attributes string `json:"attributes"`
+	UpdatedAt  int    `json:"updated_at"`
+}
+
+type Discovered struct {
+	Address   string `json:"address"`
+	Name      string `json:"name"`
+	RSSI      int    `json:"rssi"`
+	Services  string `json:"services"`
+	CompanyID int    `json:"company_id"`
+	AdvCount  int    `json:"adv_count"`
+	FirstSeen int    `json:"first_seen"`
+	LastSeen  int    `json:"last_seen"`
+}
+
+// MinValidTimestamp is 2020-01-01 UTC in unix milliseconds. A local clock
+// before it wasn't set, as on a gateway without RTC booted offline.
+const MinValidTimestamp int64 = 1577836800000
+
+// Timestamp returns the unix milliseconds of t, as stored in
+// Transaction.Timestamp.
+func Timestamp(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// TimestampTime returns the time of unix milliseconds.
+func TimestampTime(ts int64) time.Time {
+	return time.Unix(ts/1000, ts%1000*int64(time.Millisecond))
 }
@@ -0,0 +1,84 @@
+package sdk
+
+import (
+	"clients/prot"
+	"db"
+	"encoding/json"
+	"sort"
+	"strings"
+	"typeutil"
+)
+
+// batcher cuts the pending transactions into the batches of a sync. The
+// count limit adapts to the link: it halves after a timeout and doubles
+// back up to maxCount after each accepted batch.
+type batcher struct {
+	maxCount int
+	maxBytes int
+	count    int
+}
+
+func newBatcher(maxCount, maxBytes int) *batcher {
+	return &batcher{maxCount: maxCount, maxBytes: maxBytes, count: maxCount}
+}
+
+// defaultMaxBatchCount is the transactions sent per sync request unless
+// configured, see WithBatchLimits.
+const defaultMaxBatchCount = 500
+
+// next returns the first transactions of pending which fit the limits and
+// the bytes left in the budget, zero when unlimited. A transaction over the
+// byte limit on its own still makes a batch, or it would never go.
+func (b *batcher) next(pending []db.Transaction, budget int64) []prot.TransactionReq {
+	maxBytes := int64(b.maxBytes)
+	if budget > 0 && (maxBytes <= 0 || budget < maxBytes) {
+		maxBytes = budget
+	}
+	var res []prot.TransactionReq
+	size := int64(len(`{"transactions":[]}`))
+	for _, t := range pending {
+		if len(res) >= b.count {
+			break
+		}
+		tr := types.TransactionToReq(t)
+		encoded, err := json.Marshal(tr)
+		if err == nil {
+			// the separating comma
+			if len(res) > 0 && maxBytes > 0 && size+int64(len(encoded))+1 > maxBytes {
+				break
+			}
+			size += int64(len(encoded)) + 1
+		}
+		res = append(res, tr)
+	}
+	return res
+}
+
+func (b *batcher) succeeded() {
+	b.count *= 2
+	if b.count > b.maxCount {
+		b.count = b.maxCount
+	}
+}
+
+func (b *batcher) timedOut() {
+	b.count /= 2
+	if b.count < 1 {
+		b.count = 1
+	}
+}
+
+// drainOrder sorts the transactions to be synced: those of high priority
+// devices first, then oldest first.
+func drainOrder(pending []db.Transaction, highPriority map[string]bool) {
+	sort.SliceStable(pending, func(i, j int) bool {
+		hi, hj := highPriority[strings.ToLower(pending[i].DeviceHash)], highPriority[strings.ToLower(pending[j].DeviceHash)]
+		if hi != hj {
+			return hi
+		}
+		if pending[i].Timestamp != pending[j].Timestamp {
+			return pending[i].Timestamp < pending[j].Timestamp
+		}
+		return pending[i].ID < pending[j].ID
+	})
+}
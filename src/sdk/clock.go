@@ -0,0 +1,53 @@
+package sdk
+
+import (
+	"db"
+	"strconv"
+	"time"
+)
+
+// lastSyncKey prefixes the settings the last_sync of each masternode is
+// persisted in. Alone, it is the one of the gateways with a single
+// masternode.
+const lastSyncKey = "last_sync"
+
+// loadLastSyncs restores the sync cursors of the masternode endpoints.
+func (m *MoecoSDK) loadLastSyncs() error {
+	for endpoint := range m.client.LastSyncs() {
+		value, ok, err := m.db.GetSetting(lastSyncKey + ":" + endpoint)
+		if err == nil && !ok && endpoint == m.host {
+			value, ok, err = m.db.GetSetting(lastSyncKey)
+		}
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		lastSync, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		m.client.SetLastSync(endpoint, lastSync)
+	}
+	return nil
+}
+
+// saveLastSync persists the sync cursor of the masternode a sync went to.
+func (m *MoecoSDK) saveLastSync(endpoint string) error {
+	return m.db.SetSetting(lastSyncKey+":"+endpoint, strconv.Itoa(m.client.LastSyncs()[endpoint]))
+}
+
+// correctTimestamp moves a timestamp taken while the local clock wasn't set
+// to the masternode clock. It can only be done while the clock is still
+// unset, the offset to apply is unknown once it was set since.
+func (m *MoecoSDK) correctTimestamp(timestamp int64) int64 {
+	if timestamp >= db.MinValidTimestamp || db.Timestamp(time.Now()) >= db.MinValidTimestamp {
+		return timestamp
+	}
+	offset, ok := m.client.ClockOffset()
+	if !ok {
+		return timestamp
+	}
+	return timestamp + int64(offset/time.Millisecond)
+}
@@ -8,11 +8,11 @@ package sdk
  */
 
 import (
+	"alert"
 	"clients/prot"
 	"db"
 	"typeutil"
 	"ble"
-	"fmt"
 	"time"
 
 	"github.com/pkg/errors"
@@ -26,22 +26,171 @@ type MoecoSDK struct {
 	apiKey                  string
 	gatewayHash             string
 	dbPath                  string
-	lastSync                int
 	getDevicesInterval      int
 	syncInterval            int
 	charNotifyInterval      int
 	deviceConnInterval      int
+	presenceInterval        int
+	presenceWindow          int
+	deviceInfoInterval      int
+	discoveryInterval       int
+	statsInterval           int
+	monitorInterval         int
+	healthInterval          int
 	transactionsBufSize     int
 	stoped                  bool
 	errors                  *chan error
 	transactions            chan db.Transaction
-	deviceTimeouts          map[string]time.Time
 	ble                     *ble.MoecoBLE
+	bleOptions              []ble.Option
+	monitor                 *monitor
+	alertSinks              []alert.Sink
+	masternodeAlerts        bool
+	discovery               bool
+	discoveryUpload         bool
+	registryGrace           time.Duration
+	syncPolicy              SyncPolicy
+	maxBatchCount           int
+	maxBatchBytes           int
+	syncTimeout             time.Duration
+	endpoints               []string
+	selection               string
+	failback                time.Duration
+	tls                     *prot.TLSConfig
+	transport               *prot.TransportConfig
+	batcher                 *batcher
+	policy                  *syncPolicy
 	log                     *logrus.Logger
 }
 
-func NewMoecoSDK(host, apiKey, gatewayHash, dbPath string) MoecoSDK {
-	return MoecoSDK{
+// Option configures MoecoSDK, see NewMoecoSDK.
+type Option func(*MoecoSDK)
+
+// WithAdapters sets the HCI device indexes used for scanning and sessions.
+func WithAdapters(ids ...int) Option {
+	return func(m *MoecoSDK) {
+		m.bleOptions = append(m.bleOptions, ble.WithAdapters(ids...))
+	}
+}
+
+// WithBackoff sets the cooldown after a failed session with a device and the
+// limit it may grow to while sessions keep failing.
+func WithBackoff(failureInterval, maxBackoff time.Duration) Option {
+	return func(m *MoecoSDK) {
+		m.bleOptions = append(m.bleOptions, ble.WithBackoff(failureInterval, maxBackoff))
+	}
+}
+
+// WithAlertSinks adds sinks for device offline/online events.
+func WithAlertSinks(sinks ...alert.Sink) Option {
+	return func(m *MoecoSDK) {
+		m.alertSinks = append(m.alertSinks, sinks...)
+	}
+}
+
+// WithMasternodeAlerts sends device offline/online events to the masternode
+// as transactions of the device.
+func WithMasternodeAlerts() Option {
+	return func(m *MoecoSDK) {
+		m.masternodeAlerts = true
+	}
+}
+
+// WithMaxConnections sets the number of simultaneous sessions per adapter.
+func WithMaxConnections(n int) Option {
+	return func(m *MoecoSDK) {
+		m.bleOptions = append(m.bleOptions, ble.WithMaxConnections(n))
+	}
+}
+
+// WithDiscovery collects the nearby peripherals which aren't registered on
+// the masternode into the database, and uploads the list if asked to.
+func WithDiscovery(upload bool) Option {
+	return func(m *MoecoSDK) {
+		m.discovery = true
+		m.discoveryUpload = upload
+		m.bleOptions = append(m.bleOptions, ble.WithDiscovery())
+	}
+}
+
+// WithRegistryGrace sets how long the data of devices removed on the
+// masternode is kept, in case they come back.
+func WithRegistryGrace(grace time.Duration) Option {
+	return func(m *MoecoSDK) {
+		m.registryGrace = grace
+	}
+}
+
+// WithSyncPolicy sets when pending transactions are synced, see SyncPolicy.
+func WithSyncPolicy(p SyncPolicy) Option {
+	return func(m *MoecoSDK) {
+		m.syncPolicy = p
+	}
+}
+
+// WithBatchLimits bounds the transactions sent per sync request, by count
+// and by encoded size in bytes. A backlog is drained in several requests.
+// A count of zero or less keeps the default, a size of zero is unlimited.
+func WithBatchLimits(maxCount, maxBytes int) Option {
+	return func(m *MoecoSDK) {
+		if maxCount <= 0 {
+			maxCount = defaultMaxBatchCount
+		}
+		m.maxBatchCount = maxCount
+		m.maxBatchBytes = maxBytes
+	}
+}
+
+// WithSyncTimeout sets the timeout of requests to the masternode. Batches
+// shrink after a sync timed out.
+func WithSyncTimeout(timeout time.Duration) Option {
+	return func(m *MoecoSDK) {
+		m.syncTimeout = timeout
+	}
+}
+
+// WithEndpoints adds masternodes to fail over to when the host is down, in
+// order of preference.
+func WithEndpoints(urls ...string) Option {
+	return func(m *MoecoSDK) {
+		m.endpoints = append(m.endpoints, urls...)
+	}
+}
+
+// WithFailback sets how long the host, or a more preferred endpoint, must
+// be healthy again before requests go back to it.
+func WithFailback(failback time.Duration) Option {
+	return func(m *MoecoSDK) {
+		m.failback = failback
+	}
+}
+
+// WithRoundRobin spreads requests over all healthy masternode endpoints
+// instead of preferring them in order.
+func WithRoundRobin() Option {
+	return func(m *MoecoSDK) {
+		m.selection = prot.SelectRoundRobin
+	}
+}
+
+// WithTLS sets the CAs, pins and client certificate of the TLS connections
+// to the masternodes.
+func WithTLS(cfg prot.TLSConfig) Option {
+	return func(m *MoecoSDK) {
+		m.tls = &cfg
+	}
+}
+
+// WithTransport connects to the masternodes through a proxy or a Unix
+// socket, see prot.TransportConfig.
+func WithTransport(cfg prot.TransportConfig) Option {
+	return func(m *MoecoSDK) {
+		m.transport = &cfg
+	}
+}
+
+func NewMoecoSDK(host, apiKey, gatewayHash, dbPath string, opts ...Option) MoecoSDK {
+	m := MoecoSDK{
 		host:                    host,
 		apiKey:                  apiKey,
 		gatewayHash:             gatewayHash,
@@ -50,8 +199,25 @@ func NewMoecoSDK(host, apiKey, gatewayHash, dbPath string) MoecoSDK {
 		syncInterval:            4000000,
 		charNotifyInterval:      5000000,
 		deviceConnInterval:      60000000,
+		presenceInterval:        60000000,
+		presenceWindow:          60000000,
+		deviceInfoInterval:      60000000,
+		discoveryInterval:       60000000,
+		statsInterval:           3600000000,
+		monitorInterval:         10000000,
+		healthInterval:          30000000,
 		transactionsBufSize:     50,
+		registryGrace:           24 * time.Hour,
+		maxBatchCount:           defaultMaxBatchCount,
+		maxBatchBytes:           256 * 1024,
+		syncTimeout:             30 * time.Second,
+		selection:               prot.SelectPriority,
+		failback:                5 * time.Minute,
+	}
+	for _, opt := range opts {
+		opt(&m)
 	}
+	return m
 }
 
 func (m *MoecoSDK) Start(log *logrus.Logger) (error, chan error) {
@@ -61,37 +227,83 @@ func (m *MoecoSDK) Start(log *logrus.Logger) (error, chan error) {
 		return errors.Wrap(err, "db adapter init failed"), nil
 	}
 	client := prot.NewClient(m.host, m.apiKey, m.gatewayHash)
+	client.SetTimeout(m.syncTimeout)
+	client.AddEndpoints(m.endpoints...)
+	client.SetSelection(m.selection, m.failback)
+	if m.transport != nil {
+		err = client.SetTransport(*m.transport)
+		if err != nil {
+			return errors.Wrap(err, "gateway client transport config failed"), nil
+		}
+	}
+	if m.tls != nil {
+		err = client.SetTLS(*m.tls)
+		if err != nil {
+			return errors.Wrap(err, "gateway client tls config failed"), nil
+		}
+	}
 	err = client.Init(log)
 	if err != nil {
 		return errors.Wrap(err, "gateway client init failed"), nil
 	}
 
 	m.transactions = make(chan db.Transaction, m.transactionsBufSize)
+	bleOptions := append([]ble.Option{
+		ble.WithPresenceWindow(time.Duration(m.presenceWindow) * time.Microsecond),
+	}, m.bleOptions...)
 	ble, err := ble.NewMoecoBLE(log, sqliteDb, &errorsChan, &m.transactions,
-	m.transactionsBufSize, m.charNotifyInterval, m.deviceConnInterval)
+	m.transactionsBufSize, m.charNotifyInterval, m.deviceConnInterval, bleOptions...)
 	if err != nil {
 		return errors.Wrap(err, "MoecoBLE init failed"), nil
 	}
+	policy, err := newSyncPolicy(m.syncPolicy, sqliteDb)
+	if err != nil {
+		return errors.Wrap(err, "sync policy init failed"), nil
+	}
 
 	m.db = sqliteDb
+	m.monitor = newMonitor()
+	if m.masternodeAlerts {
+		m.alertSinks = append(m.alertSinks, alert.NewTransactionSink(sqliteDb))
+	}
 	m.client = &client
+	err = m.loadLastSyncs()
+	if err != nil {
+		return errors.Wrap(err, "loading last sync failed"), nil
+	}
 	m.errors = &errorsChan
 	m.ble = ble
+	m.policy = policy
+	m.batcher = newBatcher(m.maxBatchCount, m.maxBatchBytes)
 	m.log = log
 	go m.getTransactions()
 	go m.runSync()
 	go m.getDevices()
+	go m.runPresence()
+	go m.runDeviceInfo()
+	if m.discovery {
+		go m.runDiscovery()
+	}
+	go m.runStats()
+	if len(m.endpoints) > 0 {
+		go m.runHealth()
+	}
+	if len(m.alertSinks) > 0 {
+		go m.runMonitor()
+	}
 	return nil, *m.errors
 }
 
 func (m *MoecoSDK) getTransactions() {
 	for {
 		t := <-m.transactions
-		m.log.Debugf("Add transaction: %s", t)
+		t.Timestamp = m.correctTimestamp(t.Timestamp)
+		m.log.Debugf("Add transaction: %+v", t)
 		err := m.db.InsertTransaction(t)
 		if err != nil {
 			*m.errors <- errors.Wrap(err, "insert transaction failed")
 		}
+		m.monitor.seen(t.DeviceHash, db.TimestampTime(t.Timestamp))
 	}
 }
 
@@ -100,70 +312,221 @@ func (m *MoecoSDK) runSync() {
 		if m.stoped {
 			break
 		}
-		m.log.Info("Sync transactions")
-		temp, err := m.db.GetUnsendTransaction()
+		m.syncPending()
+	}
+}
+
+// syncPending sends the pending transactions the sync policy lets through,
+// batch by batch.
+func (m *MoecoSDK) syncPending() {
+	m.log.Info("Sync transactions")
+	m.observeTraffic()
+	temp, err := m.db.GetUnsendTransaction()
+	if err != nil {
+		*m.errors <- errors.Wrap(err, "getting unsend transactions failed")
+		return
+	}
+	// those stored before the masternode clock was known
+	for i := range temp {
+		temp[i].Timestamp = m.correctTimestamp(temp[i].Timestamp)
+	}
+	highPriority, err := m.highPriorityDevices()
+	if err != nil {
+		*m.errors <- errors.Wrap(err, "getting high priority devices failed")
+		return
+	}
+	temp = m.policy.selectTransactions(temp, highPriority, time.Now())
+	drainOrder(temp, highPriority)
+	// keep sending batches while the masternode accepts them and the policy
+	// lets them through, a window may close or a budget run out meanwhile
+	for !m.stoped {
+		var budget int64
+		temp, budget = m.policy.limit(temp, highPriority, time.Now())
+		tr := m.batcher.next(temp, budget)
+		if len(tr) == 0 {
+			break
+		}
+		complete, err := m.syncBatch(tr)
+		m.observeTraffic()
+		if err != nil {
+			if prot.IsTimeout(errors.Cause(err)) {
+				m.batcher.timedOut()
+			}
+			*m.errors <- err
+			break
+		}
+		if !complete {
+			// the rejected ones are sent again with the next sync
+			break
+		}
+		m.batcher.succeeded()
+		temp = temp[len(tr):]
+	}
+}
+
+// syncBatch sends a batch of transactions and marks those the masternode
+// acknowledged as sent. It tells whether all of them were.
+func (m *MoecoSDK) syncBatch(tr []prot.TransactionReq) (bool, error) {
+	res, err := m.client.SyncTransaction(prot.Transactions{
+		Transactions: tr,
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "transactions sync failed")
+	}
+	ids := res.Accepted(tr)
+	if len(ids) > 0 {
+		err = m.db.SetSendedTransaction(ids)
+		if err != nil {
+			return false, errors.Wrap(err, "set send status on transactions failed")
+		}
+	}
+	err = m.saveLastSync(res.Endpoint)
+	if err != nil {
+		return false, errors.Wrap(err, "saving last sync failed")
+	}
+	if len(ids) < len(tr) {
+		m.log.Warnf("Masternode %s accepted %d of %d transactions", res.Endpoint, len(ids), len(tr))
+		return false, nil
+	}
+	return true, nil
+}
+
+func (m *MoecoSDK) getDevices() {
+	for range time.Tick(time.Duration(m.getDevicesInterval) * time.Microsecond) {
+		if m.stoped {
+			break
+		}
+		m.log.Info("Get devices")
+		err := m.syncRegistry()
 		if err != nil {
-			*m.errors <- errors.Wrap(err, "getting unsend transactions failed")
+			*m.errors <- err
 			continue
 		}
-		if len(temp) == 0 {
-			continue
+	}
+}
+
+func (m *MoecoSDK) runPresence() {
+	for range time.Tick(time.Duration(m.presenceInterval) * time.Microsecond) {
+		if m.stoped {
+			break
 		}
-		tr := types.TrasactionsToReq(temp)
-		lastSync := 0
-		ids := make([]int, 0, len(tr))
-		for _, v := range tr {
-			if int(v.Timestamp.Unix()) > lastSync {
-				lastSync = int(v.Timestamp.Unix())
-			}
-			ids = append(ids, v.ID)
+		presences := m.ble.Presence()
+		if len(presences) == 0 {
+			continue
 		}
-		_, err = m.client.SyncTransaction(prot.Transactions{
-			Transactions: tr,
-		}, m.lastSync)
+		err := m.db.UpsertPresences(presences)
 		if err != nil {
-			*m.errors <- errors.Wrap(err, "transactions sync failed")
+			*m.errors <- errors.Wrap(err, "presence db update failed")
 			continue
 		}
-		err = m.db.SetSendedTransaction(ids)
+		m.log.Info("Report presence")
+		_, err = m.client.ReportPresence(prot.Presences{
+			Presence: types.PresencesToReq(presences, m.presenceWindow/1000000),
+		})
 		if err != nil {
-			*m.errors <- errors.Wrap(err, "set send status on transactions failed")
+			*m.errors <- errors.Wrap(err, "presence report failed")
 			continue
 		}
-		m.lastSync = int(time.Now().Unix())
 	}
 }
 
-func (m *MoecoSDK) getDevices() {
-	for range time.Tick(time.Duration(m.getDevicesInterval) * time.Microsecond) {
+// runDeviceInfo reports the device information learned on sessions, such as
+// firmware revisions, whenever it changes.
+func (m *MoecoSDK) runDeviceInfo() {
+	for range time.Tick(time.Duration(m.deviceInfoInterval) * time.Microsecond) {
 		if m.stoped {
 			break
 		}
-		m.log.Info("Get devices")
-		res, err := m.client.GetDevices()
+		devices, err := m.db.GetUnreportedDeviceInfo()
 		if err != nil {
-			*m.errors <- errors.Wrap(err, "get devices failed")
+			*m.errors <- errors.Wrap(err, "getting unreported device info failed")
 			continue
 		}
-		if len(res.Data) == 0 {
-			*m.errors <- fmt.Errorf("invalid response get device")
+		if len(devices) == 0 {
 			continue
 		}
-		deviceGroups, err := types.DeviceGroupsFromResponse(res.Data[0].DeviceGroups)
+		m.log.Info("Report device info")
+		_, err = m.client.ReportDeviceInfo(prot.DevicesInfo{
+			Devices: types.DevicesInfoToReq(devices),
+		})
 		if err != nil {
-			*m.errors <- err
+			*m.errors <- errors.Wrap(err, "device info report failed")
+			continue
+		}
+		for _, d := range devices {
+			err = m.db.SetDeviceInfoReported(d.Hash, d.InfoUpdatedAt)
+			if err != nil {
+				*m.errors <- errors.Wrap(err, "set reported status on device info failed")
+				break
+			}
+		}
+	}
+}
+
+// discoveryRetention is how long peripherals not heard anymore are kept in
+// the discovered list of the database.
+const discoveryRetention = 24 * time.Hour
+
+func (m *MoecoSDK) runDiscovery() {
+	for range time.Tick(time.Duration(m.discoveryInterval) * time.Microsecond) {
+		if m.stoped {
+			break
+		}
+		err := m.db.DeleteDiscoveredBefore(int(time.Now().Add(-discoveryRetention).Unix()))
+		if err != nil {
+			*m.errors <- errors.Wrap(err, "discovered db cleanup failed")
+		}
+		discovered := m.ble.Discovered()
+		if len(discovered) == 0 {
 			continue
 		}
-		err = m.db.InsertDeviceGroups(deviceGroups)
+		err = m.db.UpsertDiscovered(discovered)
 		if err != nil {
-			*m.errors <- errors.Wrap(err, "device groups db insertion failed")
+			*m.errors <- errors.Wrap(err, "discovered db update failed")
 			continue
 		}
-		devices := types.DevicesFromResponse(res.Data[0].Devices)
-		err = m.db.InsertDevices(devices)
+		if !m.discoveryUpload {
+			continue
+		}
+		m.log.Info("Report discovered devices")
+		_, err = m.client.ReportDiscovered(prot.DiscoveredDevices{
+			Devices: types.DiscoveredDevicesToReq(discovered),
+		})
 		if err != nil {
-			*m.errors <- errors.Wrap(err, "devices db insertion failed")
+			*m.errors <- errors.Wrap(err, "discovered devices report failed")
 			continue
 		}
 	}
 }
+
+// TransferStats returns the masternode traffic by endpoint path.
+func (m *MoecoSDK) TransferStats() map[string]prot.EndpointStats {
+	return m.client.Stats()
+}
+
+func (m *MoecoSDK) runStats() {
+	for range time.Tick(time.Duration(m.statsInterval) * time.Microsecond) {
+		if m.stoped {
+			break
+		}
+		for path, s := range m.client.Stats() {
+			m.log.Infof("Traffic of %s: %d requests (%d not modified), %d bytes sent, %d bytes received",
+				path, s.Requests, s.NotModified, s.BytesSent, s.BytesReceived)
+		}
+		for _, e := range m.client.Endpoints() {
+			m.log.Infof("Masternode %s: current %t, healthy %t, %d failures %s",
+				e.URL, e.Current, e.Healthy, e.Failures, e.LastError)
+		}
+	}
+}
+
+// runHealth probes the masternode endpoints not in use, for failover and
+// failback.
+func (m *MoecoSDK) runHealth() {
+	for range time.Tick(time.Duration(m.healthInterval) * time.Microsecond) {
+		if m.stoped {
+			break
+		}
+		m.client.CheckHealth()
+	}
+}
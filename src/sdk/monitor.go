@@ -0,0 +1,127 @@
+package sdk
+
+import (
+	"alert"
+	"strings"
+	"sync"
+	"time"
+	"typeutil"
+)
+
+// monitor raises offline/online events for whitelisted devices that stop
+// being seen for longer than their group expects.
+type monitor struct {
+	mu      sync.Mutex
+	started time.Time
+	lastTx  map[string]time.Time
+	offline map[string]bool
+}
+
+func newMonitor() *monitor {
+	return &monitor{
+		started: time.Now(),
+		lastTx:  make(map[string]time.Time),
+		offline: make(map[string]bool),
+	}
+}
+
+// seen records a transaction produced by the device.
+func (mon *monitor) seen(hash string, t time.Time) {
+	mon.mu.Lock()
+	defer mon.mu.Unlock()
+	key := strings.ToLower(hash)
+	if t.After(mon.lastTx[key]) {
+		mon.lastTx[key] = t
+	}
+}
+
+func (m *MoecoSDK) runMonitor() {
+	for range time.Tick(time.Duration(m.monitorInterval) * time.Microsecond) {
+		if m.stoped {
+			break
+		}
+		for _, e := range m.checkDevices() {
+			for _, sink := range m.alertSinks {
+				err := sink.Send(e)
+				if err != nil {
+					*m.errors <- err
+				}
+			}
+		}
+	}
+}
+
+// checkDevices returns the events for the devices whose state changed since
+// the last check.
+func (m *MoecoSDK) checkDevices() []alert.Event {
+	devices, err := m.db.GetDevices()
+	if err != nil {
+		*m.errors <- err
+		return nil
+	}
+	deviceGroupsDB, err := m.db.GetDeviceGroups()
+	if err != nil {
+		*m.errors <- err
+		return nil
+	}
+	deviceGroups, err := types.DeviceGroupsToResponse(deviceGroupsDB)
+	if err != nil {
+		*m.errors <- err
+		return nil
+	}
+	thresholds := make(map[string]int, len(deviceGroups))
+	for _, dg := range deviceGroups {
+		thresholds[strings.ToLower(dg.ExonumID)] = dg.Settings.ExpectedInterval
+	}
+	lastSeen := make(map[string]time.Time)
+	for _, p := range m.ble.Presence() {
+		if p.LastSeen == 0 {
+			continue
+		}
+		lastSeen[strings.ToLower(p.DeviceHash)] = time.Unix(int64(p.LastSeen), 0)
+	}
+
+	now := time.Now()
+	mon := m.monitor
+	mon.mu.Lock()
+	defer mon.mu.Unlock()
+
+	var events []alert.Event
+	for _, device := range devices {
+		threshold := thresholds[strings.ToLower(device.DeviceGroupID)]
+		if threshold <= 0 {
+			continue
+		}
+		key := strings.ToLower(device.Hash)
+		seen := lastSeen[key]
+		if t := mon.lastTx[key]; t.After(seen) {
+			seen = t
+		}
+		// nothing can be heard while the gateway isn't running, so every
+		// device gets its full threshold after start
+		since := seen
+		if since.Before(mon.started) {
+			since = mon.started
+		}
+
+		offline := now.Sub(since) > time.Duration(threshold)*time.Second
+		if offline == mon.offline[key] {
+			continue
+		}
+		mon.offline[key] = offline
+
+		e := alert.Event{
+			Type:          alert.EventOnline,
+			DeviceHash:    device.Hash,
+			DeviceGroupID: device.DeviceGroupID,
+			LastSeen:      seen,
+			Threshold:     threshold,
+			Timestamp:     now,
+		}
+		if offline {
+			e.Type = alert.EventOffline
+		}
+		events = append(events, e)
+	}
+	return events
+}
@@ -0,0 +1,249 @@
+package sdk
+
+import (
+	"clients/prot"
+	"db"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+	"typeutil"
+
+	"github.com/pkg/errors"
+)
+
+// SyncWindow is a time of day range, as offsets from local midnight. A
+// window ending before it starts spans midnight.
+type SyncWindow struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+func (w SyncWindow) contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+	if w.Start <= w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+// SyncPolicy decides when pending transactions are synced. The zero value
+// syncs on every tick, like the gateway always did.
+type SyncPolicy struct {
+	// Syncs of normal priority transactions only happen within the windows,
+	// any time when there are none.
+	Windows []SyncWindow
+	// A sync is due once MinBatch transactions are pending or the oldest one
+	// waits for MaxAge. Zero values don't hold transactions back.
+	MinBatch int
+	MaxAge   time.Duration
+	// Bytes exchanged with the masternode per day and per calendar month.
+	// Once a budget is used up, only high priority transactions are synced
+	// until it resets. Zero is unlimited.
+	DailyBudget   int64
+	MonthlyBudget int64
+}
+
+// syncUsageKey is the setting the bandwidth usage is persisted in.
+const syncUsageKey = "sync_usage"
+
+// syncUsage is the traffic of the current day and month.
+type syncUsage struct {
+	Day        string `json:"day"`
+	DayBytes   int64  `json:"day_bytes"`
+	Month      string `json:"month"`
+	MonthBytes int64  `json:"month_bytes"`
+}
+
+// syncPolicy applies a SyncPolicy, keeping track of the bandwidth used.
+type syncPolicy struct {
+	mu       sync.Mutex
+	policy   SyncPolicy
+	db       *db.DBAdapter
+	usage    syncUsage
+	observed int64
+}
+
+func newSyncPolicy(policy SyncPolicy, database *db.DBAdapter) (*syncPolicy, error) {
+	p := &syncPolicy{policy: policy, db: database}
+	value, ok, err := database.GetSetting(syncUsageKey)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		err = json.Unmarshal([]byte(value), &p.usage)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// roll starts the counting of a new day or month.
+func (p *syncPolicy) roll(now time.Time) {
+	day, month := now.Format("2006-01-02"), now.Format("2006-01")
+	if p.usage.Day != day {
+		p.usage.Day, p.usage.DayBytes = day, 0
+	}
+	if p.usage.Month != month {
+		p.usage.Month, p.usage.MonthBytes = month, 0
+	}
+}
+
+func (p *syncPolicy) overBudget(now time.Time) bool {
+	p.roll(now)
+	return (p.policy.DailyBudget > 0 && p.usage.DayBytes >= p.policy.DailyBudget) ||
+		(p.policy.MonthlyBudget > 0 && p.usage.MonthBytes >= p.policy.MonthlyBudget)
+}
+
+func (p *syncPolicy) inWindow(now time.Time) bool {
+	if len(p.policy.Windows) == 0 {
+		return true
+	}
+	for _, w := range p.policy.Windows {
+		if w.contains(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// due tells whether the pending transactions make a batch worth syncing.
+func (p *syncPolicy) due(pending []db.Transaction, now time.Time) bool {
+	if len(pending) == 0 {
+		return false
+	}
+	if p.policy.MinBatch <= 0 && p.policy.MaxAge <= 0 {
+		return true
+	}
+	if p.policy.MinBatch > 0 && len(pending) >= p.policy.MinBatch {
+		return true
+	}
+	if p.policy.MaxAge > 0 {
+		for _, t := range pending {
+			if now.Sub(db.TimestampTime(t.Timestamp)) >= p.policy.MaxAge {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// selectTransactions returns the pending transactions to be synced now.
+// Transactions of high priority devices always go, the others only when
+// within a window, under the budget and the batch is due.
+func (p *syncPolicy) selectTransactions(pending []db.Transaction, highPriority map[string]bool, now time.Time) []db.Transaction {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var high, normal []db.Transaction
+	for _, t := range pending {
+		if highPriority[strings.ToLower(t.DeviceHash)] {
+			high = append(high, t)
+		} else {
+			normal = append(normal, t)
+		}
+	}
+	if p.inWindow(now) && !p.overBudget(now) && p.due(normal, now) {
+		return append(high, normal...)
+	}
+	return high
+}
+
+// limit returns the transactions of the drain which may still be sent, in
+// order, and the bytes left in the budgets for them, zero when unlimited.
+// The normal priority ones stop once the window closes or a budget is used
+// up, as selectTransactions only checks when the drain starts.
+func (p *syncPolicy) limit(pending []db.Transaction, highPriority map[string]bool, now time.Time) ([]db.Transaction, int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.inWindow(now) && !p.overBudget(now) {
+		return pending, p.budgetLeft()
+	}
+	var high []db.Transaction
+	for _, t := range pending {
+		if highPriority[strings.ToLower(t.DeviceHash)] {
+			high = append(high, t)
+		}
+	}
+	return high, 0
+}
+
+// budgetLeft returns the bytes left in the tighter budget, zero when
+// unlimited. Must be called after roll.
+func (p *syncPolicy) budgetLeft() int64 {
+	var left int64
+	if p.policy.DailyBudget > 0 {
+		left = p.policy.DailyBudget - p.usage.DayBytes
+	}
+	if p.policy.MonthlyBudget > 0 {
+		month := p.policy.MonthlyBudget - p.usage.MonthBytes
+		if left == 0 || month < left {
+			left = month
+		}
+	}
+	return left
+}
+
+// observe accounts the traffic since the last call, given the total bytes
+// exchanged with the masternode so far.
+func (p *syncPolicy) observe(total int64, now time.Time) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delta := total - p.observed
+	p.observed = total
+	if delta <= 0 {
+		return nil
+	}
+	p.roll(now)
+	p.usage.DayBytes += delta
+	p.usage.MonthBytes += delta
+	b, err := json.Marshal(p.usage)
+	if err != nil {
+		return err
+	}
+	return p.db.SetSetting(syncUsageKey, string(b))
+}
+
+// observeTraffic accounts all traffic with the masternode against the
+// budgets, not only the one of syncs.
+func (m *MoecoSDK) observeTraffic() {
+	var total int64
+	for _, s := range m.client.Stats() {
+		total += s.BytesSent + s.BytesReceived
+	}
+	err := m.policy.observe(total, time.Now())
+	if err != nil {
+		*m.errors <- errors.Wrap(err, "bandwidth usage update failed")
+	}
+}
+
+// highPriorityDevices returns the lowercased hashes of the devices whose
+// group syncs with high priority.
+func (m *MoecoSDK) highPriorityDevices() (map[string]bool, error) {
+	deviceGroupsDB, err := m.db.GetDeviceGroups()
+	if err != nil {
+		return nil, err
+	}
+	high := make(map[string]bool)
+	for _, g := range deviceGroupsDB {
+		deviceGroup, err := types.DeviceGroupToResponse(g)
+		if err != nil {
+			return nil, err
+		}
+		if deviceGroup.Settings.Priority == prot.PriorityHigh {
+			high[strings.ToLower(g.ExonumID)] = true
+		}
+	}
+	devices, err := m.db.GetDevicesWithRemoved()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]bool)
+	for _, d := range devices {
+		if high[strings.ToLower(d.DeviceGroupID)] {
+			res[strings.ToLower(d.Hash)] = true
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,193 @@
+package sdk
+
+import (
+	"clients/prot"
+	"db"
+	"fmt"
+	"strings"
+	"time"
+	"typeutil"
+
+	"github.com/pkg/errors"
+)
+
+// registryPageSize is the number of devices requested per page.
+const registryPageSize = 100
+
+// registry is the device registry of the masternode.
+type registry struct {
+	devices      []prot.Device
+	deviceGroups []prot.DeviceGroup
+	// All pages were fetched, removals can only be detected then.
+	complete bool
+	// No page changed since the last fetch.
+	unchanged bool
+}
+
+// fetchRegistry pulls every page of the device registry.
+func (m *MoecoSDK) fetchRegistry() (*registry, error) {
+	reg := &registry{unchanged: true}
+	seenGroups := make(map[string]bool)
+	total := -1
+	for offset := 0; ; {
+		res, err := m.client.GetDevices(offset, registryPageSize)
+		if err != nil {
+			return nil, errors.Wrap(err, "get devices failed")
+		}
+		if len(res.Data) == 0 {
+			return nil, fmt.Errorf("invalid response get device")
+		}
+		reg.unchanged = reg.unchanged && res.NotModified
+		// the offsets shift when the registry changes between pages, devices
+		// may have been skipped
+		if total >= 0 && res.Meta.Total != total {
+			m.log.Warnf("Device registry changed from %d to %d devices while paging, removals skipped", total, res.Meta.Total)
+			reg.unchanged = false
+			return reg, nil
+		}
+		total = res.Meta.Total
+		page := res.Data[0]
+		reg.devices = append(reg.devices, page.Devices...)
+		// every page carries the groups of its devices
+		for _, g := range page.DeviceGroups {
+			if !seenGroups[strings.ToLower(g.ExonumID)] {
+				seenGroups[strings.ToLower(g.ExonumID)] = true
+				reg.deviceGroups = append(reg.deviceGroups, g)
+			}
+		}
+		offset += len(page.Devices)
+		// a registry without Meta.Total isn't paginated
+		if res.Meta.Total == 0 || offset >= res.Meta.Total {
+			reg.complete = true
+			return reg, nil
+		}
+		if len(page.Devices) == 0 {
+			m.log.Warnf("Device registry ended at %d of %d devices, removals skipped", offset, res.Meta.Total)
+			reg.unchanged = false
+			return reg, nil
+		}
+	}
+}
+
+// syncRegistry applies the device registry of the masternode to the local
+// whitelist. Devices and device groups missing from the registry are
+// tombstoned and deleted once the grace period is over, unless they come
+// back.
+func (m *MoecoSDK) syncRegistry() error {
+	reg, err := m.fetchRegistry()
+	if err != nil {
+		return err
+	}
+	if reg.unchanged {
+		return m.purgeRegistry(0, 0, 0, len(reg.devices))
+	}
+
+	localGroups, err := m.db.GetDeviceGroupsWithRemoved()
+	if err != nil {
+		return errors.Wrap(err, "getting device groups failed")
+	}
+	groupsLocal := make(map[string]db.DeviceGroup, len(localGroups))
+	for _, g := range localGroups {
+		groupsLocal[strings.ToLower(g.ExonumID)] = g
+	}
+	deviceGroups, err := types.DeviceGroupsFromResponse(reg.deviceGroups)
+	if err != nil {
+		return err
+	}
+	var groupUpserts []db.DeviceGroup
+	remoteGroupIDs := make(map[string]bool, len(deviceGroups))
+	for _, g := range deviceGroups {
+		id := strings.ToLower(g.ExonumID)
+		remoteGroupIDs[id] = true
+		if l, ok := groupsLocal[id]; ok && l.RemovedAt == 0 && l.UpdatedAt == g.UpdatedAt && g.UpdatedAt != 0 {
+			continue
+		}
+		groupUpserts = append(groupUpserts, g)
+	}
+	err = m.db.InsertDeviceGroups(groupUpserts)
+	if err != nil {
+		return errors.Wrap(err, "device groups db insertion failed")
+	}
+
+	localDevices, err := m.db.GetDevicesWithRemoved()
+	if err != nil {
+		return errors.Wrap(err, "getting devices failed")
+	}
+	local := make(map[string]db.Device, len(localDevices))
+	for _, d := range localDevices {
+		local[strings.ToLower(d.Hash)] = d
+	}
+	var added, changed, unchanged, removed int
+	var deviceUpserts []db.Device
+	remote := make(map[string]bool, len(reg.devices))
+	for _, d := range types.DevicesFromResponse(reg.devices) {
+		hash := strings.ToLower(d.Hash)
+		remote[hash] = true
+		l, ok := local[hash]
+		switch {
+		case !ok || l.RemovedAt != 0:
+			added++
+		case l.UpdatedAt == d.UpdatedAt && d.UpdatedAt != 0:
+			unchanged++
+			continue
+		default:
+			changed++
+		}
+		deviceUpserts = append(deviceUpserts, d)
+	}
+	err = m.db.InsertDevices(deviceUpserts)
+	if err != nil {
+		return errors.Wrap(err, "devices db insertion failed")
+	}
+
+	if reg.complete {
+		now := int(time.Now().Unix())
+		for hash, d := range local {
+			if remote[hash] || d.RemovedAt != 0 {
+				continue
+			}
+			err = m.db.RemoveDevice(d.Hash, now)
+			if err != nil {
+				return errors.Wrap(err, "device removal failed")
+			}
+			removed++
+		}
+		for _, g := range localGroups {
+			if remoteGroupIDs[strings.ToLower(g.ExonumID)] || g.RemovedAt != 0 {
+				continue
+			}
+			err = m.db.RemoveDeviceGroup(g.ExonumID, now)
+			if err != nil {
+				return errors.Wrap(err, "device group removal failed")
+			}
+		}
+	}
+
+	// the BLE side caches the whitelist
+	if m.ble != nil {
+		err = m.ble.RefreshWhitelist()
+		if err != nil {
+			return errors.Wrap(err, "whitelist refresh failed")
+		}
+	}
+
+	return m.purgeRegistry(added, changed, removed, unchanged)
+}
+
+// purgeRegistry deletes the devices and device groups removed for longer
+// than the grace period and logs the summary of the registry sync.
+func (m *MoecoSDK) purgeRegistry(added, changed, removed, unchanged int) error {
+	before := int(time.Now().Add(-m.registryGrace).Unix())
+	purged, err := m.db.PurgeRemovedDevices(before)
+	if err != nil {
+		return errors.Wrap(err, "removed devices purge failed")
+	}
+	purgedGroups, err := m.db.PurgeRemovedDeviceGroups(before)
+	if err != nil {
+		return errors.Wrap(err, "removed device groups purge failed")
+	}
+
+	m.log.Infof("Device registry: %d added, %d changed, %d removed, %d purged, %d unchanged, %d groups purged",
+		added, changed, removed, len(purged), unchanged, purgedGroups)
+	return nil
+}
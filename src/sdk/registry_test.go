@@ -0,0 +1,104 @@
+package sdk
+
+import (
+	"clients/prot"
+	"clients/prot/prottest"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func testDevices(n int, group string) []prot.Device {
+	var res []prot.Device
+	for i := 0; i < n; i++ {
+		res = append(res, prot.Device{
+			Hash:          fmt.Sprintf("aa:bb:cc:dd:%02x:%02x", i/256, i%256),
+			DeviceGroupID: group,
+		})
+	}
+	return res
+}
+
+// registryCounts returns the whitelisted devices and device groups, and
+// those including the tombstones.
+func registryCounts(t *testing.T, m *MoecoSDK) string {
+	devices, err := m.db.GetDevices()
+	if err != nil {
+		t.Fatalf("getting devices failed: %s", err)
+	}
+	allDevices, err := m.db.GetDevicesWithRemoved()
+	if err != nil {
+		t.Fatalf("getting devices failed: %s", err)
+	}
+	groups, err := m.db.GetDeviceGroups()
+	if err != nil {
+		t.Fatalf("getting device groups failed: %s", err)
+	}
+	allGroups, err := m.db.GetDeviceGroupsWithRemoved()
+	if err != nil {
+		t.Fatalf("getting device groups failed: %s", err)
+	}
+	return fmt.Sprintf("devices %d/%d groups %d/%d", len(devices), len(allDevices), len(groups), len(allGroups))
+}
+
+func TestSyncRegistryRemovals(t *testing.T) {
+	srv := prottest.NewServer(testAPIKey)
+	defer srv.Close()
+	m := newTestSDK(t, srv)
+	g1, g2 := prot.DeviceGroup{ExonumID: "g1"}, prot.DeviceGroup{ExonumID: "g2"}
+	both := append(testDevices(1, "g1"), prot.Device{Hash: "ff:ff:ff:ff:ff:ff", DeviceGroupID: "g2"})
+
+	steps := []struct {
+		name    string
+		devices []prot.Device
+		groups  []prot.DeviceGroup
+		grace   time.Duration
+		want    string
+	}{
+		{name: "added", devices: both, groups: []prot.DeviceGroup{g1, g2}, grace: time.Hour, want: "devices 2/2 groups 2/2"},
+		{name: "removed", devices: both[:1], groups: []prot.DeviceGroup{g1}, grace: time.Hour, want: "devices 1/2 groups 1/2"},
+		{name: "back", devices: both, groups: []prot.DeviceGroup{g1, g2}, grace: time.Hour, want: "devices 2/2 groups 2/2"},
+		{name: "removed again", devices: both[:1], groups: []prot.DeviceGroup{g1}, grace: time.Hour, want: "devices 1/2 groups 1/2"},
+		{name: "purged", devices: both[:1], groups: []prot.DeviceGroup{g1}, grace: -time.Hour, want: "devices 1/1 groups 1/1"},
+	}
+	for _, step := range steps {
+		srv.SetRegistry(step.devices, step.groups)
+		m.registryGrace = step.grace
+		err := m.syncRegistry()
+		if err != nil {
+			t.Fatalf("%s: registry sync failed: %s", step.name, err)
+		}
+		if got := registryCounts(t, m); got != step.want {
+			t.Errorf("%s: %s, want %s", step.name, got, step.want)
+		}
+	}
+}
+
+func TestSyncRegistryChangedWhilePaging(t *testing.T) {
+	srv := prottest.NewServer(testAPIKey)
+	defer srv.Close()
+	m := newTestSDK(t, srv)
+	devices := testDevices(registryPageSize+50, "g1")
+	groups := []prot.DeviceGroup{{ExonumID: "g1"}}
+	srv.SetRegistry(devices, groups)
+	err := m.syncRegistry()
+	if err != nil {
+		t.Fatalf("registry sync failed: %s", err)
+	}
+
+	// the first device is removed once the first page is served, the
+	// offsets of the second one shift by one
+	srv.Inject(prottest.DevicesPath, prottest.Fault{}, prottest.Fault{Latency: 200 * time.Millisecond})
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		srv.SetRegistry(devices[1:], groups)
+	}()
+	err = m.syncRegistry()
+	if err != nil {
+		t.Fatalf("registry sync failed: %s", err)
+	}
+	want := fmt.Sprintf("devices %d/%d groups 1/1", len(devices), len(devices))
+	if got := registryCounts(t, m); got != want {
+		t.Errorf("%s, want %s", got, want)
+	}
+}
@@ -0,0 +1,244 @@
+package sdk
+
+import (
+	"clients/prot"
+	"clients/prot/prottest"
+	"db"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const testAPIKey = "API_KEY"
+
+// newTestSDK sets up the sdk as Start does, without BLE and loops, against
+// the fake masternode.
+func newTestSDK(t *testing.T, srv *prottest.Server, opts ...Option) *MoecoSDK {
+	log := logrus.New()
+	log.Out = ioutil.Discard
+	m := NewMoecoSDK(srv.URL, testAPIKey, "NODE_UUID", filepath.Join(t.TempDir(), "moeco.db"), opts...)
+
+	database, err := db.NewDBAdapter(m.dbPath)
+	if err != nil {
+		t.Fatalf("db adapter init failed: %s", err)
+	}
+	client := prot.NewClient(m.host, m.apiKey, m.gatewayHash)
+	client.SetTimeout(m.syncTimeout)
+	err = client.Init(log)
+	if err != nil {
+		t.Fatalf("gateway client init failed: %s", err)
+	}
+	policy, err := newSyncPolicy(m.syncPolicy, database)
+	if err != nil {
+		t.Fatalf("sync policy init failed: %s", err)
+	}
+	errorsChan := make(chan error, 100)
+
+	m.db = database
+	m.client = &client
+	m.policy = policy
+	m.batcher = newBatcher(m.maxBatchCount, m.maxBatchBytes)
+	m.errors = &errorsChan
+	m.log = log
+	return &m
+}
+
+// insertTransactions stores n pending transactions, their IDs are 1 to n.
+func insertTransactions(t *testing.T, m *MoecoSDK, n int) {
+	now := db.Timestamp(time.Now())
+	for i := 0; i < n; i++ {
+		err := m.db.InsertTransaction(db.Transaction{
+			Hash:       fmt.Sprintf("%064x", i+1),
+			DeviceHash: "aa:bb:cc:dd:ee:ff",
+			Timestamp:  now + int64(i),
+			Uplink:     1,
+			Payload:    "{}",
+		})
+		if err != nil {
+			t.Fatalf("insert transaction failed: %s", err)
+		}
+	}
+}
+
+// pendingIDs returns the IDs of the transactions not marked sent.
+func pendingIDs(t *testing.T, m *MoecoSDK) []int {
+	pending, err := m.db.GetUnsendTransaction()
+	if err != nil {
+		t.Fatalf("getting unsend transactions failed: %s", err)
+	}
+	var ids []int
+	for _, tr := range pending {
+		ids = append(ids, tr.ID)
+	}
+	return ids
+}
+
+func errorCount(m *MoecoSDK) int {
+	n := 0
+	for {
+		select {
+		case <-*m.errors:
+			n++
+		default:
+			return n
+		}
+	}
+}
+
+func TestSyncPending(t *testing.T) {
+	srv := prottest.NewServer(testAPIKey)
+	defer srv.Close()
+	m := newTestSDK(t, srv, WithBatchLimits(2, 0))
+	insertTransactions(t, m, 5)
+
+	m.syncPending()
+
+	if n := errorCount(m); n != 0 {
+		t.Errorf("%d errors, want none", n)
+	}
+	if ids := pendingIDs(t, m); len(ids) != 0 {
+		t.Errorf("pending %v, want none", ids)
+	}
+	if n := len(srv.RequestsTo(prottest.SyncPath)); n != 3 {
+		t.Errorf("server received %d syncs, want 3 batches", n)
+	}
+	stored := srv.Transactions()
+	if len(stored) != 5 {
+		t.Fatalf("server stored %d transactions, want 5", len(stored))
+	}
+	for i, tr := range stored {
+		if tr.ID != i+1 {
+			t.Errorf("transaction %d stored with ID %d, want oldest first", i, tr.ID)
+		}
+	}
+	value, ok, err := m.db.GetSetting(lastSyncKey + ":" + srv.URL)
+	if err != nil || !ok || value == "0" {
+		t.Errorf("last sync %q (%t, %v), want it saved", value, ok, err)
+	}
+}
+
+func TestSyncPendingFaults(t *testing.T) {
+	tests := []struct {
+		name  string
+		fault prottest.Fault
+		// transactions left pending and errors reported
+		pending []int
+		errors  int
+	}{
+		{
+			name:    "latency",
+			fault:   prottest.Fault{Latency: 200 * time.Millisecond},
+			pending: []int{1, 2, 3, 4},
+			errors:  1,
+		},
+		{
+			name:    "server error",
+			fault:   prottest.Fault{Status: http.StatusServiceUnavailable},
+			pending: []int{1, 2, 3, 4},
+			errors:  1,
+		},
+		{
+			name:    "client error",
+			fault:   prottest.Fault{Status: http.StatusBadRequest},
+			pending: []int{1, 2, 3, 4},
+			errors:  1,
+		},
+		{
+			name:    "malformed",
+			fault:   prottest.Fault{Malformed: true},
+			pending: []int{1, 2, 3, 4},
+			errors:  1,
+		},
+		{
+			name:    "meta error",
+			fault:   prottest.Fault{MetaError: "storage unavailable"},
+			pending: []int{1, 2, 3, 4},
+			errors:  1,
+		},
+		{
+			// the rejected transaction stops the drain, the next batch
+			// isn't sent
+			name:    "partial acceptance",
+			fault:   prottest.Fault{Reject: 1},
+			pending: []int{2, 3, 4},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := prottest.NewServer(testAPIKey)
+			defer srv.Close()
+			m := newTestSDK(t, srv, WithBatchLimits(2, 0), WithSyncTimeout(100*time.Millisecond))
+			insertTransactions(t, m, 4)
+			srv.Inject(prottest.SyncPath, tt.fault)
+
+			m.syncPending()
+
+			if n := errorCount(m); n != tt.errors {
+				t.Errorf("%d errors, want %d", n, tt.errors)
+			}
+			if ids := pendingIDs(t, m); fmt.Sprint(ids) != fmt.Sprint(tt.pending) {
+				t.Errorf("pending %v, want %v", ids, tt.pending)
+			}
+			if n := len(srv.RequestsTo(prottest.SyncPath)); n != 1 {
+				t.Errorf("server received %d syncs, want 1", n)
+			}
+			if tt.fault.Latency > 0 {
+				if m.batcher.count != 1 {
+					t.Errorf("batch limit %d after a timeout, want 1", m.batcher.count)
+				}
+				// let the server finish the request the client gave up on
+				time.Sleep(2 * tt.fault.Latency)
+			}
+
+			// everything left goes with the next sync
+			m.syncPending()
+			if ids := pendingIDs(t, m); len(ids) != 0 {
+				t.Errorf("pending %v after the next sync, want none", ids)
+			}
+		})
+	}
+}
+
+func TestSyncPendingDefaultBatchLimit(t *testing.T) {
+	srv := prottest.NewServer(testAPIKey)
+	defer srv.Close()
+	m := newTestSDK(t, srv, WithBatchLimits(0, 0))
+	insertTransactions(t, m, 3)
+
+	m.syncPending()
+
+	if ids := pendingIDs(t, m); len(ids) != 0 {
+		t.Errorf("pending %v, want none", ids)
+	}
+	if n := len(srv.RequestsTo(prottest.SyncPath)); n != 1 {
+		t.Errorf("server received %d syncs, want 1", n)
+	}
+}
+
+func TestSyncPendingBudget(t *testing.T) {
+	srv := prottest.NewServer(testAPIKey)
+	defer srv.Close()
+	m := newTestSDK(t, srv, WithBatchLimits(2, 0))
+	insertTransactions(t, m, 4)
+
+	// the budget is all but used up by authenticating
+	m.observeTraffic()
+	m.policy.policy.DailyBudget = m.policy.usage.DayBytes + 1
+
+	m.syncPending()
+
+	if n := errorCount(m); n != 0 {
+		t.Errorf("%d errors, want none", n)
+	}
+	if n := len(srv.RequestsTo(prottest.SyncPath)); n != 1 {
+		t.Errorf("server received %d syncs, want 1", n)
+	}
+	if ids := pendingIDs(t, m); fmt.Sprint(ids) != "[2 3 4]" {
+		t.Errorf("pending %v, want [2 3 4]", ids)
+	}
+}
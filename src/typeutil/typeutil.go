@@ -4,6 +4,7 @@ import (
 	"clients/prot"
 	"db"
 	"encoding/json"
+	"strings"
 	"time"
 )
 
@@ -29,9 +30,9 @@ func boolToInt(b bool) int {
 func TransactionToReq(t db.Transaction) prot.TransactionReq {
 	return prot.TransactionReq{
 		ID:         t.ID,
-		//Hash:       t.Hash,
+		Hash:       t.Hash,
 		DeviceHash: t.DeviceHash,
-		Timestamp:  intToTime(t.Timestamp),
+		Timestamp:  db.TimestampTime(t.Timestamp),
 		Uplink:     intToBool(t.Uplink),
 		Payload:    t.Payload,
 		Status:     1,
@@ -56,6 +57,8 @@ func DeviceFromResponse(device prot.Device) db.Device {
 		ExonumID:      device.ExonumID,
 		DeviceGroupID: device.DeviceGroupID,
 		OwnerKey:      device.OwnerKey,
+		MacKey:        device.MacKey,
+		IRK:           device.IRK,
 	}
 }
 
@@ -77,6 +80,8 @@ func DeviceToResponse(device db.Device) prot.Device {
 		ExonumID:      device.ExonumID,
 		DeviceGroupID: device.DeviceGroupID,
 		OwnerKey:      device.OwnerKey,
+		MacKey:        device.MacKey,
+		IRK:           device.IRK,
 	}
 }
 
@@ -93,6 +98,10 @@ func DeviceGroupFromResponse(deviceGroup prot.DeviceGroup) (*db.DeviceGroup, err
 	if err != nil {
 		return nil, err
 	}
+	settingsStr, err := json.Marshal(deviceGroup.Settings)
+	if err != nil {
+		return nil, err
+	}
 	return &db.DeviceGroup{
 		ID:               deviceGroup.ID,
 		Name:             deviceGroup.Name,
@@ -104,6 +113,7 @@ func DeviceGroupFromResponse(deviceGroup prot.DeviceGroup) (*db.DeviceGroup, err
 		UpdatedAt: timeToInt(deviceGroup.UpdatedAt),
 		ExonumID: deviceGroup.ExonumID,
 		OwnerKey: deviceGroup.OwnerKey,
+		Settings: string(settingsStr),
 	}, nil
 }
 
@@ -125,6 +135,13 @@ func DeviceGroupToResponse(deviceGroup db.DeviceGroup) (*prot.DeviceGroup, error
 	if err != nil {
 		return nil, err
 	}
+	var settings prot.DeviceGroupSettings
+	if deviceGroup.Settings != "" {
+		err = json.Unmarshal([]byte(deviceGroup.Settings), &settings)
+		if err != nil {
+			return nil, err
+		}
+	}
 	return &prot.DeviceGroup{
 		ID: deviceGroup.ID,
 		Name: deviceGroup.Name,
@@ -136,6 +153,7 @@ func DeviceGroupToResponse(deviceGroup db.DeviceGroup) (*prot.DeviceGroup, error
 		UpdatedAt: intToTime(deviceGroup.UpdatedAt),
 		ExonumID: deviceGroup.ExonumID,
 		OwnerKey: deviceGroup.OwnerKey,
+		Settings: settings,
 	}, nil
 }
 
@@ -150,3 +168,95 @@ func DeviceGroupsToResponse(deviceGroups []db.DeviceGroup) ([]prot.DeviceGroup,
 	}
 	return ret, nil
 }
+
+func PresenceToReq(p db.Presence, window int) prot.PresenceReq {
+	var lastSession *time.Time
+	if p.LastSession != 0 {
+		t := intToTime(p.LastSession)
+		lastSession = &t
+	}
+	return prot.PresenceReq{
+		DeviceHash:  p.DeviceHash,
+		LastSeen:    intToTime(p.LastSeen),
+		RSSI:        p.RSSI,
+		AdvCount:    p.AdvCount,
+		AdvWindow:   window,
+		LastSession: lastSession,
+	}
+}
+
+func PresencesToReq(presences []db.Presence, window int) []prot.PresenceReq {
+	res := make([]prot.PresenceReq, 0, len(presences))
+	for _, v := range presences {
+		res = append(res, PresenceToReq(v, window))
+	}
+	return res
+}
+
+func DeviceInfoToReq(d db.Device) prot.DeviceInfoReq {
+	var battery *int
+	if d.BatteryLevel >= 0 {
+		level := d.BatteryLevel
+		battery = &level
+	}
+	var firstSession, lastSession *time.Time
+	if d.FirstSessionAt != 0 {
+		t := intToTime(d.FirstSessionAt)
+		firstSession = &t
+	}
+	if d.LastSessionAt != 0 {
+		t := intToTime(d.LastSessionAt)
+		lastSession = &t
+	}
+	return prot.DeviceInfoReq{
+		DeviceHash:       d.Hash,
+		ManufacturerName: d.ManufacturerName,
+		ModelNumber:      d.ModelNumber,
+		SerialNumber:     d.SerialNumber,
+		HardwareRevision: d.HardwareRevision,
+		FirmwareRevision: d.FirmwareRevision,
+		SoftwareRevision: d.SoftwareRevision,
+		BatteryLevel:     battery,
+		FirstSession:     firstSession,
+		LastSession:      lastSession,
+		UpdatedAt:        intToTime(d.InfoUpdatedAt),
+	}
+}
+
+func DevicesInfoToReq(devices []db.Device) []prot.DeviceInfoReq {
+	res := make([]prot.DeviceInfoReq, 0, len(devices))
+	for _, v := range devices {
+		res = append(res, DeviceInfoToReq(v))
+	}
+	return res
+}
+
+func DiscoveredDeviceToReq(d db.Discovered) prot.DiscoveredReq {
+	var companyID *int
+	if d.CompanyID >= 0 {
+		id := d.CompanyID
+		companyID = &id
+	}
+	services := []string{}
+	if d.Services != "" {
+		services = strings.Split(d.Services, ",")
+	}
+	return prot.DiscoveredReq{
+		Address:   d.Address,
+		Name:      d.Name,
+		RSSI:      d.RSSI,
+		Services:  services,
+		CompanyID: companyID,
+		AdvCount:  d.AdvCount,
+		FirstSeen: intToTime(d.FirstSeen),
+		LastSeen:  intToTime(d.LastSeen),
+	}
+}
+
+func DiscoveredDevicesToReq(discovered []db.Discovered) []prot.DiscoveredReq {
+	res := make([]prot.DiscoveredReq, 0, len(discovered))
+	for _, v := range discovered {
+		res = append(res, DiscoveredDeviceToReq(v))
+	}
+	return res
+}